@@ -1,3 +1,10 @@
 module bjoernblessin.de/gorkbunddns
 
 go 1.24.0
+
+require (
+	golang.org/x/net v0.48.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/text v0.32.0 // indirect
@@ -1,127 +1,115 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
-	"strconv"
 	"time"
 
+	"bjoernblessin.de/gorkbunddns/src/config"
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
 	"bjoernblessin.de/gorkbunddns/src/records"
-	"bjoernblessin.de/gorkbunddns/src/shared"
 	"bjoernblessin.de/gorkbunddns/src/util/assert"
 	"bjoernblessin.de/gorkbunddns/src/util/env"
 	"bjoernblessin.de/gorkbunddns/src/util/logger"
 )
 
-const timeoutSecondsEnvKey string = "TIMEOUT"
-const apikeyEnvKey string = "APIKEY"
-const secretkeyEnvKey string = "SECRETKEY"
-const defaultTimeoutSeconds int = 600
+const requestTimeout = 30 * time.Second
+
+// setupTimeout bounds the requests at startup and is the minimum time an update may take, e.g. if Porkbun asks to retry much later.
+const setupTimeout = 5 * time.Minute
 
 func main() {
 	log.Println("Running...")
 
-	apikey, secretkey, timeoutSeconds := validateEnvironment()
+	configPath := flag.String("config", "", "Path to a YAML or JSON configuration file. Defaults to the environment variable "+config.FileEnvKey+".")
+	flag.Parse()
+
+	cfg, clients := validateConfig(*configPath)
 
 	// Program never exits on its own after this point
 
-	runLoop(apikey, secretkey, timeoutSeconds)
+	runLoop(cfg, clients)
 }
 
-// validateEnvironment checks environment variables for misconfiguration.
-// If one was found, an error message is printed and the program exits.
-func validateEnvironment() (apikey string, secretkey string, timeoutSeconds int) {
-	apikey = env.ReadNonEmptyRequiredEnv(apikeyEnvKey)
-	secretkey = env.ReadNonEmptyRequiredEnv(secretkeyEnvKey)
-
-	testApiKeys(apikey, secretkey)
-
-	timeout, present := env.ReadOptionalEnv(timeoutSecondsEnvKey)
-	if present {
-		var err error
-		timeoutSeconds, err = strconv.Atoi(timeout)
-		if err != nil {
-			logger.Errorf("Environment variable %s must be a number. Was: %s", timeoutSecondsEnvKey, timeout)
-			assert.Never()
-		}
+// validateConfig loads the configuration file at configPath and the environment variables and checks them for misconfiguration.
+// If configPath is empty, the environment variable CONFIG_FILE is used. Without both only environment variables are read.
+// If a problem was found, an error message is printed and the program exits.
+func validateConfig(configPath string) (*config.Config, map[config.Credentials]*porkbun.Client) {
+	if configPath == "" {
+		configPath, _ = env.ReadOptionalEnv(config.FileEnvKey)
+	}
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		logger.Errorf("Invalid configuration:\n%s", err)
+		assert.Never()
+	}
 
-		if timeoutSeconds <= 0 {
-			logger.Errorf("Environment variable %s must be greater than 0. Was: %d", timeoutSecondsEnvKey, timeoutSeconds)
-			assert.Never()
+	if configPath != "" {
+		log.Printf("Configuration file %s loaded.", configPath)
+	}
+
+	clients := map[config.Credentials]*porkbun.Client{}
+
+	for _, credentials := range cfg.AllCredentials() {
+		client := porkbun.NewClient(cfg.APIURL, &http.Client{Timeout: requestTimeout}, credentials.APIKey, credentials.SecretKey)
+
+		if cfg.RetryAttempts > 0 {
+			retryPolicy := porkbun.DefaultRetryPolicy
+			retryPolicy.MaxAttempts = cfg.RetryAttempts
+			client.SetRetryPolicy(retryPolicy)
 		}
-	} else {
-		timeoutSeconds = defaultTimeoutSeconds
+
+		testApiKeys(client, credentials)
+
+		clients[credentials] = client
 	}
 
-	env.ReadNonEmptyRequiredEnv(records.DomainsEnvKey)
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
 
-	IPv4Value := env.ReadValidEnv(records.IPv4EnvKey, []string{"", "true", "false"})
-	IPv6Value := env.ReadValidEnv(records.IPv6EnvKey, []string{"", records.IPv6PrefixOnlyValue, records.IPv6HostIPValue, records.IPv6FritzBoxIPValue, "false"})
-	if IPv4Value == "false" && (IPv6Value == "" || IPv6Value == "false") {
-		logger.Errorf("Both IPv4 and IPv6 updates are disabled. No updates will be performed, so execution is unnecessary.")
+	if !records.ValidateDomains(ctx, cfg, clients) {
+		logger.Errorf("The configuration contains invalid domains, see the report above.")
 		assert.Never()
 	}
 
-	return apikey, secretkey, timeoutSeconds
+	return cfg, clients
 }
 
 // runLoop indefinitely executes the DNS updates.
-func runLoop(apikey string, secretkey string, timeoutSeconds int) {
+func runLoop(cfg *config.Config, clients map[config.Credentials]*porkbun.Client) {
+	updater := records.NewUpdater(cfg, clients)
+	interval := time.Duration(cfg.TimeoutSeconds) * time.Second
+
 	for {
-		records.Update(apikey, secretkey)
+		// An update gives up on retries that would delay the next one
+		ctx, cancel := context.WithTimeout(context.Background(), max(interval, setupTimeout))
+		updater.Update(ctx)
+		cancel()
 
-		log.Printf("Sleeping for %d seconds.", timeoutSeconds)
-		time.Sleep(time.Duration(timeoutSeconds * int(time.Second)))
+		log.Printf("Sleeping for %d seconds.", cfg.TimeoutSeconds)
+		time.Sleep(interval)
 	}
 }
 
-// testApiKeys pings the Porkbun server and validates the provided API keys.
+// testApiKeys pings the Porkbun server and validates the API key pair credentials.
 // Stops execution if something fails.
-func testApiKeys(apikey string, secretkey string) {
-	pingRequest := shared.RequestCredentials{SecretAPIKey: secretkey, APIKey: apikey}
-	jsonBody, err := json.Marshal(pingRequest)
-	if err != nil {
-		logger.Errorf("Cannot json encode environment variables %s and %s, please check them.", apikeyEnvKey, secretkeyEnvKey)
-		assert.Never()
-	}
-
-	resp, err := http.Post("https://api.porkbun.com/api/json/v3/ping", "application/json", bytes.NewReader(jsonBody))
-	if err != nil {
-		logger.Errorf("Ping to the Porkbun server failed. This may be temporary, please try again later.")
-		assert.Never()
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		prettyJSON := _JSONResponseBodyToPrettyByteArray(resp.Body)
+func testApiKeys(client *porkbun.Client, credentials config.Credentials) {
+	ctx, cancel := context.WithTimeout(context.Background(), setupTimeout)
+	defer cancel()
 
-		logger.Errorf("Environment variable %s or %s is invalid:\n%s", apikeyEnvKey, secretkeyEnvKey, prettyJSON)
+	yourIP, err := client.Ping(ctx)
+	if errors.Is(err, porkbun.ErrInvalidCredentials) {
+		logger.Errorf("API key pair %s is invalid:\n%s", credentials, err)
 		assert.Never()
 	}
-
-	log.Printf("%s and %s successfully validated.", apikeyEnvKey, secretkeyEnvKey)
-}
-
-func _JSONResponseBodyToPrettyByteArray(reader io.Reader) []byte {
-	responseBody, err := io.ReadAll(reader)
-	assert.IsNil(err)
-
-	var responseJsonPretty []byte
-
-	var responseJson map[string]any
-	err = json.Unmarshal(responseBody, &responseJson)
 	if err != nil {
-		logger.Warnf("Porkbun server returned invalid JSON format while validating API keys.")
-		responseJsonPretty = responseBody
-	} else {
-		responseJsonPretty, err = json.MarshalIndent(responseJson, "", "    ")
-		if err != nil {
-			assert.Never("JSON encoding (marshalling) failed. This should only happen with channel, complex and function values, which we don't use.", err, responseJson)
-		}
+		logger.Errorf("Ping to the Porkbun server failed. This may be temporary, please try again later.\n%s", err)
+		assert.Never()
 	}
 
-	return responseJsonPretty
+	log.Printf("API key pair %s successfully validated. Porkbun sees this host as %s.", credentials, yourIP)
 }
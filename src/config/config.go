@@ -0,0 +1,790 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
+	"bjoernblessin.de/gorkbunddns/src/util/env"
+	"bjoernblessin.de/gorkbunddns/src/wanip"
+	"gopkg.in/yaml.v3"
+)
+
+const FileEnvKey = "CONFIG_FILE"
+const DomainsEnvKey = "DOMAINS"
+const APIKeyEnvKey = "APIKEY"
+const SecretKeyEnvKey = "SECRETKEY"
+const APIURLEnvKey = "API_URL"
+const TimeoutSecondsEnvKey = "TIMEOUT"
+const RetryAttemptsEnvKey = "RETRY_ATTEMPTS"
+const SweepEnvKey = "SWEEP"
+const IPv4EnvKey = "IPV4"
+const IPv6EnvKey = "IPV6"
+const IPv6PrefixOnlyValue = "prefix-only"
+const IPv6HostIPValue = "host-ip"
+const IPv6FritzBoxIPValue = "fritzbox-ip"
+const IPv6WANIPValue = "wan-ip"
+const IPv4SourcesEnvKey = "IPV4_SOURCES"
+const IPv6SourcesEnvKey = "IPV6_SOURCES"
+const STUNServersEnvKey = "STUN_SERVERS"
+const DNSQueriesEnvKey = "DNS_QUERIES"
+const InterfaceEnvKey = "INTERFACE"
+const FritzBoxHostEnvKey = "FRITZBOX_HOST"
+const FritzBoxUsernameEnvKey = "FRITZBOX_USERNAME"
+const FritzBoxPasswordEnvKey = "FRITZBOX_PASSWORD"
+const FritzBoxHTTPSEnvKey = "FRITZBOX_HTTPS"
+const QuorumEnvKey = "QUORUM"
+const CGNATEnvKey = "CGNAT"
+const CGNATKeepValue = "keep"
+const CGNATWithdrawValue = "withdraw"
+const MulRecordsEnvKey = "MULTIPLE_RECORDS"
+const MulRecordsSkipValue = "skip"
+const MulRecordsUnifyValue = "unify"
+const TTLEnvKey = "TTL"
+const TTLPerDomainEnvKey = "TTL_PER_DOMAIN"
+
+// MinTTL is the lowest TTL in seconds accepted by Porkbun. Lower TTLs are stored as MinTTL.
+const MinTTL = 600
+
+const IPv4PerDomainEnvKey = "IPV4_PER_DOMAIN"
+const IPv6PerDomainEnvKey = "IPV6_PER_DOMAIN"
+const IPv6SuffixPerDomainEnvKey = "IPV6_SUFFIX_PER_DOMAIN"
+const IPv6SubnetIDPerDomainEnvKey = "IPV6_SUBNET_ID_PER_DOMAIN"
+const NotesEnvKey = "NOTES"
+const StrictOwnershipEnvKey = "STRICT_OWNERSHIP"
+
+const defaultTimeoutSeconds = 600
+
+// defaultSources are asked for the WAN IP if no sources are configured. The FRITZ!Box comes first for backwards compatibility.
+var defaultSources = []string{wanip.FritzBoxSourceName, wanip.HTTPSourceName}
+
+// Config is the validated configuration, merged from the configuration file and the environment variables.
+type Config struct {
+	APIURL         string
+	TimeoutSeconds int
+	// RetryAttempts is the number of attempts per Porkbun request. 0 means that the default retry policy is used.
+	RetryAttempts int
+	// IPv4Sources are the names of the sources asked in order for the WAN IPv4, see [wanip.NewSource].
+	IPv4Sources []string
+	// IPv6Sources are the names of the sources asked in order for the WAN IPv6 with IPv6WANIPValue.
+	IPv6Sources []string
+	// STUNServers are the host:port addresses asked by the stun source.
+	STUNServers []string
+	// DNSQueries are the lookups performed by the dns source.
+	DNSQueries []wanip.DNSQuery
+	// Interface is the network interface the interface source reads from. Empty means all interfaces.
+	Interface string
+	// FritzBoxHost is the host name or address of the FRITZ!Box.
+	FritzBoxHost string
+	// FritzBoxUsername and FritzBoxPassword authenticate TR-064 requests to the FRITZ!Box. Empty means no authentication.
+	FritzBoxUsername string
+	FritzBoxPassword string
+	// FritzBoxHTTPS enables TR-064 via HTTPS.
+	FritzBoxHTTPS bool
+	// Quorum is the number of sources of IPv4Sources and IPv6Sources that must report the same IP before it's published.
+	Quorum int
+	// CGNAT is either CGNATKeepValue or CGNATWithdrawValue, the latter deletes the A-Records while the WAN IPv4 is a carrier-grade NAT address.
+	CGNAT string
+	// Sweep enables rewriting all A- and AAAA-Records of the configured zones that still point to a previous IP.
+	Sweep   bool
+	Domains []Domain
+}
+
+// Credentials is a Porkbun API key pair.
+type Credentials struct {
+	APIKey    string
+	SecretKey string
+}
+
+// String returns a short hash of the API key that identifies c in log messages without revealing any part of it, e.g. "#3f2a9c1e".
+func (c Credentials) String() string {
+	hash := sha256.Sum256([]byte(c.APIKey))
+	return "#" + hex.EncodeToString(hash[:4])
+}
+
+// Domain is one domain to update together with its effective settings.
+type Domain struct {
+	// Entry is the domain as configured, e.g. "büro@example.de". FQDN, Subdomain and RootDomain are always ASCII (punycode).
+	Entry       string
+	FQDN        string
+	Subdomain   string
+	RootDomain  string
+	Credentials Credentials
+	// IPv4 enables updates of the A-Record.
+	IPv4 bool
+	// IPv6 is the source of the AAAA-Record, one of IPv6PrefixOnlyValue, IPv6HostIPValue, IPv6FritzBoxIPValue, IPv6WANIPValue or "false".
+	IPv6 string
+	// IPv6Suffix is the fixed interface ID of the AAAA-Record in IPv6PrefixOnlyValue mode, e.g. "::211:32ff:fe12:3456".
+	// Empty means that the interface ID of the existing record is kept.
+	IPv6Suffix string
+	// IPv6SubnetID selects the subnet of the delegated prefix in IPv6PrefixOnlyValue mode, i.e. the bits between the prefix length and 64.
+	// Nil means that the subnet ID of the existing record is kept.
+	IPv6SubnetID *uint64
+	// TTL of the records in seconds. 0 means that the TTL isn't managed and Porkbun's default is used for new records.
+	TTL int
+	// Notes is the ownership marker written to the notes of the records. Empty means that records aren't tagged.
+	Notes string
+	// StrictOwnership restricts edits and deletes to records tagged with Notes.
+	StrictOwnership bool
+	// MultipleRecords is either MulRecordsSkipValue or MulRecordsUnifyValue.
+	MultipleRecords string
+}
+
+// AllCredentials returns all distinct API key pairs used by the domains of c.
+func (c *Config) AllCredentials() []Credentials {
+	var credentials []Credentials
+
+	for _, domain := range c.Domains {
+		if !slices.Contains(credentials, domain.Credentials) {
+			credentials = append(credentials, domain.Credentials)
+		}
+	}
+
+	return credentials
+}
+
+// Error is a problem with a single configuration value.
+type Error struct {
+	// Position is where the value was set, e.g. "gorkbunddns.yaml:12" or "environment variable TTL".
+	Position string
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Position, e.Message)
+}
+
+// setting is a single configuration value and where it was set.
+type setting struct {
+	value string
+	// line in the configuration file, 0 if the value isn't from the file.
+	line int
+	// envKey is the environment variable, empty if the value isn't from the environment.
+	envKey string
+}
+
+// UnmarshalYAML accepts a single value or a list of single values, which is stored comma-separated like in an environment variable.
+func (s *setting) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var values []string
+
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: expected a single value", item.Line)
+			}
+
+			values = append(values, item.Value)
+		}
+
+		*s = setting{value: strings.Join(values, ","), line: node.Line}
+		return nil
+	}
+
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: expected a single value", node.Line)
+	}
+
+	*s = setting{value: node.Value, line: node.Line}
+	return nil
+}
+
+func (s setting) isSet() bool {
+	return s.line != 0 || s.envKey != ""
+}
+
+// or returns s if it's set and fallback otherwise.
+func (s setting) or(fallback setting) setting {
+	if s.isSet() {
+		return s
+	}
+
+	return fallback
+}
+
+// settings are the values that can be set globally and per domain.
+type settings struct {
+	APIKey          setting `yaml:"apikey"`
+	SecretKey       setting `yaml:"secretkey"`
+	IPv4            setting `yaml:"ipv4"`
+	IPv6            setting `yaml:"ipv6"`
+	IPv6Suffix      setting `yaml:"ipv6Suffix"`
+	IPv6SubnetID    setting `yaml:"ipv6SubnetID"`
+	TTL             setting `yaml:"ttl"`
+	Notes           setting `yaml:"notes"`
+	StrictOwnership setting `yaml:"strictOwnership"`
+	MultipleRecords setting `yaml:"multipleRecords"`
+}
+
+// or returns s where every unset value is replaced by the value of fallback.
+func (s settings) or(fallback settings) settings {
+	return settings{
+		APIKey:          s.APIKey.or(fallback.APIKey),
+		SecretKey:       s.SecretKey.or(fallback.SecretKey),
+		IPv4:            s.IPv4.or(fallback.IPv4),
+		IPv6:            s.IPv6.or(fallback.IPv6),
+		IPv6Suffix:      s.IPv6Suffix.or(fallback.IPv6Suffix),
+		IPv6SubnetID:    s.IPv6SubnetID.or(fallback.IPv6SubnetID),
+		TTL:             s.TTL.or(fallback.TTL),
+		Notes:           s.Notes.or(fallback.Notes),
+		StrictOwnership: s.StrictOwnership.or(fallback.StrictOwnership),
+		MultipleRecords: s.MultipleRecords.or(fallback.MultipleRecords),
+	}
+}
+
+// contains reports whether value is one of the values of s.
+func (s settings) contains(value setting) bool {
+	values := []setting{s.APIKey, s.SecretKey, s.IPv4, s.IPv6, s.IPv6Suffix, s.IPv6SubnetID, s.TTL, s.Notes, s.StrictOwnership, s.MultipleRecords}
+	return slices.Contains(values, value)
+}
+
+type fileDomain struct {
+	Name     setting `yaml:"name"`
+	settings `yaml:",inline"`
+}
+
+// file is the raw content of the configuration file, overridden by environment variables.
+type file struct {
+	settings         `yaml:",inline"`
+	APIURL           setting      `yaml:"apiURL"`
+	Timeout          setting      `yaml:"timeout"`
+	RetryAttempts    setting      `yaml:"retryAttempts"`
+	Sweep            setting      `yaml:"sweep"`
+	IPv4Sources      setting      `yaml:"ipv4Sources"`
+	IPv6Sources      setting      `yaml:"ipv6Sources"`
+	STUNServers      setting      `yaml:"stunServers"`
+	DNSQueries       setting      `yaml:"dnsQueries"`
+	Interface        setting      `yaml:"interface"`
+	Quorum           setting      `yaml:"quorum"`
+	FritzBoxHost     setting      `yaml:"fritzboxHost"`
+	FritzBoxUsername setting      `yaml:"fritzboxUsername"`
+	FritzBoxPassword setting      `yaml:"fritzboxPassword"`
+	FritzBoxHTTPS    setting      `yaml:"fritzboxHTTPS"`
+	CGNAT            setting      `yaml:"cgnat"`
+	Domains          []fileDomain `yaml:"domains"`
+
+	// perDomain maps the keys of perDomainEnvKeys to the values they set per domain, e.g. TTL_PER_DOMAIN=vpn.example.com=600.
+	perDomain map[string]map[string]setting
+}
+
+// perDomainEnvKeys are the environment variables that override a setting for single domains.
+var perDomainEnvKeys = map[string]func(s *settings) *setting{
+	TTLPerDomainEnvKey:          func(s *settings) *setting { return &s.TTL },
+	IPv4PerDomainEnvKey:         func(s *settings) *setting { return &s.IPv4 },
+	IPv6PerDomainEnvKey:         func(s *settings) *setting { return &s.IPv6 },
+	IPv6SuffixPerDomainEnvKey:   func(s *settings) *setting { return &s.IPv6Suffix },
+	IPv6SubnetIDPerDomainEnvKey: func(s *settings) *setting { return &s.IPv6SubnetID },
+}
+
+// Load reads the configuration file at path, applies the environment variables as overrides and validates the result.
+// path may be empty, then only environment variables are used.
+// All problems are returned at once, each with the file and line or the environment variable it originates from.
+func Load(path string) (*Config, error) {
+	var f file
+
+	if path != "" {
+		err := f.read(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	v := validator{path: path}
+	f.applyEnv(&v)
+	cfg := v.validate(&f)
+
+	if len(v.errs) > 0 {
+		return nil, errors.Join(v.errs...)
+	}
+
+	return cfg, nil
+}
+
+// read decodes the YAML (or JSON) configuration file at path into f. Unknown keys are rejected.
+func (f *file) read(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not read configuration file. %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(f)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv overrides the values of f with the environment variables that are set.
+func (f *file) applyEnv(v *validator) {
+	overrides := map[string]*setting{
+		APIKeyEnvKey:           &f.APIKey,
+		SecretKeyEnvKey:        &f.SecretKey,
+		APIURLEnvKey:           &f.APIURL,
+		TimeoutSecondsEnvKey:   &f.Timeout,
+		RetryAttemptsEnvKey:    &f.RetryAttempts,
+		SweepEnvKey:            &f.Sweep,
+		IPv4SourcesEnvKey:      &f.IPv4Sources,
+		IPv6SourcesEnvKey:      &f.IPv6Sources,
+		STUNServersEnvKey:      &f.STUNServers,
+		DNSQueriesEnvKey:       &f.DNSQueries,
+		InterfaceEnvKey:        &f.Interface,
+		QuorumEnvKey:           &f.Quorum,
+		FritzBoxHostEnvKey:     &f.FritzBoxHost,
+		FritzBoxUsernameEnvKey: &f.FritzBoxUsername,
+		FritzBoxPasswordEnvKey: &f.FritzBoxPassword,
+		FritzBoxHTTPSEnvKey:    &f.FritzBoxHTTPS,
+		CGNATEnvKey:            &f.CGNAT,
+		IPv4EnvKey:             &f.IPv4,
+		IPv6EnvKey:             &f.IPv6,
+		MulRecordsEnvKey:       &f.MultipleRecords,
+		TTLEnvKey:              &f.TTL,
+		NotesEnvKey:            &f.Notes,
+		StrictOwnershipEnvKey:  &f.StrictOwnership,
+	}
+
+	// An empty variable counts as not set, e.g. "IPV6=" in a compose file keeps the default
+	for key, target := range overrides {
+		if value, present := env.ReadOptionalEnv(key); present && value != "" {
+			*target = setting{value: value, envKey: key}
+		}
+	}
+
+	// DOMAINS replaces the domain list of the file. Domains that also have a block in the file keep their settings.
+	if domainsString, present := env.ReadOptionalEnv(DomainsEnvKey); present && domainsString != "" {
+		var domains []fileDomain
+
+		for _, entry := range strings.Split(domainsString, ",") {
+			domain := fileDomain{Name: setting{value: entry, envKey: DomainsEnvKey}}
+
+			for _, fileDomain := range f.Domains {
+				if fileDomain.Name.value == entry {
+					domain.settings = fileDomain.settings
+				}
+			}
+
+			domains = append(domains, domain)
+		}
+
+		f.Domains = domains
+	}
+
+	f.perDomain = map[string]map[string]setting{}
+	for _, key := range slices.Sorted(maps.Keys(perDomainEnvKeys)) {
+		f.perDomain[key] = v.readMapEnv(key)
+	}
+}
+
+// validator collects all problems found while validating a configuration.
+type validator struct {
+	// path of the configuration file, empty if there is none.
+	path string
+	errs []error
+}
+
+// errorf records a problem with the value of s.
+func (v *validator) errorf(s setting, format string, args ...any) {
+	position := fmt.Sprintf("%s:%d", v.path, s.line)
+	if s.envKey != "" {
+		position = fmt.Sprintf("environment variable %s", s.envKey)
+	}
+
+	v.errs = append(v.errs, &Error{Position: position, Message: fmt.Sprintf(format, args...)})
+}
+
+// readMapEnv reads an environment variable of the form "key1=value1,key2=value2".
+func (v *validator) readMapEnv(key string) map[string]setting {
+	values := map[string]setting{}
+
+	mapString, _ := env.ReadOptionalEnv(key)
+	if mapString == "" {
+		return values
+	}
+
+	for _, entry := range strings.Split(mapString, ",") {
+		entryKey, entryValue, found := strings.Cut(entry, "=")
+		if !found || entryKey == "" {
+			v.errorf(setting{envKey: key}, "must be a comma-separated list of key=value pairs. Invalid entry: %s", entry)
+			continue
+		}
+
+		if _, duplicate := values[entryKey]; duplicate {
+			v.errorf(setting{envKey: key}, "contains %s more than once.", entryKey)
+			continue
+		}
+
+		values[entryKey] = setting{value: entryValue, envKey: key}
+	}
+
+	return values
+}
+
+// positiveInt parses s as integer greater than 0. Returns defaultValue if s isn't set.
+func (v *validator) positiveInt(s setting, defaultValue int) int {
+	if !s.isSet() {
+		return defaultValue
+	}
+
+	value, err := strconv.Atoi(s.value)
+	if err != nil {
+		v.errorf(s, "must be a number. Was: %s", s.value)
+		return defaultValue
+	}
+
+	if value <= 0 {
+		v.errorf(s, "must be greater than 0. Was: %d", value)
+		return defaultValue
+	}
+
+	return value
+}
+
+// ttl parses s as TTL in seconds, which must be at least MinTTL. Returns 0 if s isn't set.
+// Porkbun would store a lower TTL as MinTTL, so the record would never match the configured TTL and be edited every update.
+func (v *validator) ttl(s setting) int {
+	value := v.positiveInt(s, 0)
+
+	if value != 0 && value < MinTTL {
+		v.errorf(s, "must be at least %d, the minimum TTL of Porkbun. Was: %d", MinTTL, value)
+		return 0
+	}
+
+	return value
+}
+
+// oneOf checks that s is one of validValues. Returns defaultValue if s isn't set.
+func (v *validator) oneOf(s setting, defaultValue string, validValues []string) string {
+	if !s.isSet() {
+		return defaultValue
+	}
+
+	if !slices.Contains(validValues, s.value) {
+		v.errorf(s, "must be one of %v but was %s.", validValues, s.value)
+		return defaultValue
+	}
+
+	return s.value
+}
+
+// interfaceID parses s as the interface ID of an IPv6 address, i.e. an IPv6 address whose first 64 bits are 0.
+// Returns the address in its canonical form.
+func (v *validator) interfaceID(s setting) string {
+	ip := net.ParseIP(s.value)
+	if ip == nil || ip.To4() != nil || !slices.Equal(ip[:8], make(net.IP, 8)) {
+		v.errorf(s, "must be an IPv6 interface ID like ::211:32ff:fe12:3456. Was: %s", s.value)
+		return ""
+	}
+
+	return ip.String()
+}
+
+// subnetID parses s as hexadecimal IPv6 subnet ID, e.g. "1a" (or "0x1a") for 2001:db8:12:341a::/64 in 2001:db8:12:3400::/56.
+func (v *validator) subnetID(s setting) *uint64 {
+	value, err := strconv.ParseUint(strings.TrimPrefix(s.value, "0x"), 16, 64)
+	if err != nil {
+		v.errorf(s, "must be a hexadecimal subnet ID like 1a. Was: %s", s.value)
+		return nil
+	}
+
+	return &value
+}
+
+// sources parses s as comma-separated list of IP source names for family. Returns all sources in a default order if s isn't set.
+func (v *validator) sources(s setting, family wanip.Family) []string {
+	if !s.isSet() {
+		return slices.Clone(defaultSources)
+	}
+
+	var names []string
+
+	for _, name := range strings.Split(s.value, ",") {
+		name = strings.TrimSpace(name)
+
+		if _, err := wanip.NewSource(name, family, wanip.Options{}); err != nil {
+			v.errorf(s, "%s", err)
+			continue
+		}
+
+		if slices.Contains(names, name) {
+			v.errorf(s, "contains %s more than once.", name)
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// hostPorts parses s as comma-separated list of host:port addresses. Returns defaultValue if s isn't set.
+func (v *validator) hostPorts(s setting, defaultValue []string) []string {
+	if !s.isSet() {
+		return slices.Clone(defaultValue)
+	}
+
+	var addresses []string
+
+	for _, address := range strings.Split(s.value, ",") {
+		address = strings.TrimSpace(address)
+
+		host, port, err := net.SplitHostPort(address)
+		if portNumber, portErr := strconv.Atoi(port); err != nil || host == "" || portErr != nil || portNumber <= 0 || portNumber > 65535 {
+			v.errorf(s, "must be a comma-separated list of host:port addresses. Invalid entry: %s", address)
+			continue
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+// dnsQueries parses s as comma-separated list of DNS queries, see [wanip.ParseDNSQuery]. Returns the default queries if s isn't set.
+func (v *validator) dnsQueries(s setting) []wanip.DNSQuery {
+	if !s.isSet() {
+		return slices.Clone(wanip.DefaultDNSQueries)
+	}
+
+	var queries []wanip.DNSQuery
+
+	for _, entry := range strings.Split(s.value, ",") {
+		query, err := wanip.ParseDNSQuery(strings.TrimSpace(entry))
+		if err != nil {
+			v.errorf(s, "%s", err)
+			continue
+		}
+
+		queries = append(queries, query)
+	}
+
+	return queries
+}
+
+// host checks that s is a host name or IP address without scheme or port. Returns defaultValue if s isn't set.
+func (v *validator) host(s setting, defaultValue string) string {
+	if !s.isSet() {
+		return defaultValue
+	}
+
+	if _, err := netip.ParseAddr(s.value); err == nil {
+		return s.value
+	}
+
+	hostURL, err := url.Parse("http://" + s.value)
+	if err != nil || hostURL.Host != s.value || hostURL.Port() != "" {
+		v.errorf(s, "must be a host name or IP address like fritz.box or 192.168.178.1. Was: %s", s.value)
+		return defaultValue
+	}
+
+	return s.value
+}
+
+// quorum checks that the sources used by the domains of cfg are enough to reach cfg.Quorum.
+func (v *validator) quorum(s setting, cfg *Config) {
+	usesIPv4 := slices.ContainsFunc(cfg.Domains, func(domain Domain) bool { return domain.IPv4 })
+	usesIPv6 := slices.ContainsFunc(cfg.Domains, func(domain Domain) bool { return domain.IPv6 == IPv6WANIPValue })
+
+	if usesIPv4 && cfg.Quorum > len(cfg.IPv4Sources) {
+		v.errorf(s, "must not be greater than the number of sources in %s (%d). Was: %d", IPv4SourcesEnvKey, len(cfg.IPv4Sources), cfg.Quorum)
+	}
+
+	if usesIPv6 && cfg.Quorum > len(cfg.IPv6Sources) {
+		v.errorf(s, "must not be greater than the number of sources in %s (%d). Was: %d", IPv6SourcesEnvKey, len(cfg.IPv6Sources), cfg.Quorum)
+	}
+}
+
+// validate checks all values of f and returns the resulting configuration.
+func (v *validator) validate(f *file) *Config {
+	cfg := &Config{
+		APIURL:           porkbun.DefaultBaseURL,
+		TimeoutSeconds:   v.positiveInt(f.Timeout, defaultTimeoutSeconds),
+		RetryAttempts:    v.positiveInt(f.RetryAttempts, 0),
+		Sweep:            v.oneOf(f.Sweep, "false", []string{"true", "false"}) == "true",
+		IPv4Sources:      v.sources(f.IPv4Sources, wanip.IPv4),
+		IPv6Sources:      v.sources(f.IPv6Sources, wanip.IPv6),
+		STUNServers:      v.hostPorts(f.STUNServers, wanip.DefaultSTUNServers),
+		DNSQueries:       v.dnsQueries(f.DNSQueries),
+		Interface:        f.Interface.value,
+		Quorum:           v.positiveInt(f.Quorum, 1),
+		FritzBoxHost:     v.host(f.FritzBoxHost, wanip.DefaultFritzBoxHost),
+		FritzBoxUsername: f.FritzBoxUsername.value,
+		FritzBoxPassword: f.FritzBoxPassword.value,
+		FritzBoxHTTPS:    v.oneOf(f.FritzBoxHTTPS, "false", []string{"true", "false"}) == "true",
+		CGNAT:            v.oneOf(f.CGNAT, CGNATKeepValue, []string{CGNATKeepValue, CGNATWithdrawValue}),
+	}
+
+	if f.APIURL.isSet() {
+		apiURL, err := url.Parse(f.APIURL.value)
+		if err != nil || (apiURL.Scheme != "http" && apiURL.Scheme != "https") || apiURL.Host == "" {
+			v.errorf(f.APIURL, "must be an absolute http or https URL. Was: %s", f.APIURL.value)
+		}
+		cfg.APIURL = f.APIURL.value
+	}
+
+	if len(f.Domains) == 0 {
+		v.errs = append(v.errs, fmt.Errorf("No domains configured. Set the environment variable %s or add domains to the configuration file.", DomainsEnvKey))
+	}
+
+	v.checkSettings(f.settings)
+
+	perDomainUsed := map[perDomainKey]bool{}
+
+	for _, fileDomain := range f.Domains {
+		domain, valid := v.validateDomain(fileDomain, f.settings, f.perDomain, perDomainUsed)
+		if !valid {
+			continue
+		}
+
+		if slices.ContainsFunc(cfg.Domains, func(other Domain) bool { return other.FQDN == domain.FQDN }) {
+			v.errorf(fileDomain.Name, "%s is configured more than once.", domain.FQDN)
+			continue
+		}
+
+		cfg.Domains = append(cfg.Domains, domain)
+	}
+
+	v.quorum(f.Quorum, cfg)
+
+	for _, envKey := range slices.Sorted(maps.Keys(f.perDomain)) {
+		for _, name := range slices.Sorted(maps.Keys(f.perDomain[envKey])) {
+			if !perDomainUsed[perDomainKey{envKey: envKey, name: name}] {
+				v.errorf(f.perDomain[envKey][name], "%s is not a configured domain.", name)
+			}
+		}
+	}
+
+	return cfg
+}
+
+// checkSettings checks the format of the values of global once, so that problems aren't reported again for every domain inheriting them.
+func (v *validator) checkSettings(global settings) {
+	v.oneOf(global.IPv4, "", []string{"true", "false"})
+	v.oneOf(global.IPv6, "", ipv6Values)
+	v.ttl(global.TTL)
+	v.oneOf(global.StrictOwnership, "", []string{"true", "false"})
+	v.oneOf(global.MultipleRecords, "", mulRecordsValues)
+
+	if global.IPv6Suffix.isSet() {
+		v.interfaceID(global.IPv6Suffix)
+	}
+
+	if global.IPv6SubnetID.isSet() {
+		v.subnetID(global.IPv6SubnetID)
+	}
+}
+
+// ipv6Values are the valid values of IPv6EnvKey. Empty is the same as "false".
+var ipv6Values = []string{IPv6PrefixOnlyValue, IPv6HostIPValue, IPv6FritzBoxIPValue, IPv6WANIPValue, "false", ""}
+
+// mulRecordsValues are the valid values of MulRecordsEnvKey. Empty is the same as MulRecordsSkipValue.
+var mulRecordsValues = []string{MulRecordsSkipValue, MulRecordsUnifyValue, ""}
+
+// perDomainKey identifies a single entry of a per domain environment variable.
+type perDomainKey struct {
+	envKey string
+	name   string
+}
+
+// validateDomain checks the name and the settings of fileDomain. Unset settings are taken from global, values of perDomain take precedence.
+// perDomainUsed marks the entries of perDomain that matched this domain.
+func (v *validator) validateDomain(fileDomain fileDomain, global settings, perDomain map[string]map[string]setting, perDomainUsed map[perDomainKey]bool) (Domain, bool) {
+	entry := fileDomain.Name.value
+
+	asciiEntry, err := toASCIIEntry(entry)
+	if err != nil {
+		v.errorf(fileDomain.Name, "%q is not a valid domain. %s", entry, err)
+		return Domain{}, false
+	}
+
+	if !isDomainEntryValid(asciiEntry) {
+		v.errorf(fileDomain.Name, "%q is not a valid domain.", entry)
+		return Domain{}, false
+	}
+
+	fqdn, subdomain, rootDomain := splitDomainEntry(asciiEntry)
+	effective := fileDomain.settings.or(global)
+
+	for envKey, target := range perDomainEnvKeys {
+		for _, name := range []string{entry, fqdn} {
+			if value, present := perDomain[envKey][name]; present {
+				*target(&effective) = value
+				perDomainUsed[perDomainKey{envKey: envKey, name: name}] = true
+			}
+		}
+	}
+
+	// Problems of values inherited from global were already reported by checkSettings
+	inherited := &validator{path: v.path}
+	valueValidator := func(s setting) *validator {
+		if global.contains(s) {
+			return inherited
+		}
+		return v
+	}
+
+	domain := Domain{
+		Entry:           entry,
+		FQDN:            fqdn,
+		Subdomain:       subdomain,
+		RootDomain:      rootDomain,
+		Credentials:     Credentials{APIKey: effective.APIKey.value, SecretKey: effective.SecretKey.value},
+		IPv4:            valueValidator(effective.IPv4).oneOf(effective.IPv4, "true", []string{"true", "false"}) == "true",
+		IPv6:            valueValidator(effective.IPv6).oneOf(effective.IPv6, "false", ipv6Values),
+		TTL:             valueValidator(effective.TTL).ttl(effective.TTL),
+		Notes:           effective.Notes.value,
+		StrictOwnership: valueValidator(effective.StrictOwnership).oneOf(effective.StrictOwnership, "false", []string{"true", "false"}) == "true",
+		MultipleRecords: valueValidator(effective.MultipleRecords).oneOf(effective.MultipleRecords, MulRecordsSkipValue, mulRecordsValues),
+	}
+
+	if domain.MultipleRecords == "" {
+		domain.MultipleRecords = MulRecordsSkipValue
+	}
+
+	if domain.IPv6 == "" {
+		domain.IPv6 = "false"
+	}
+
+	if effective.IPv6Suffix.isSet() {
+		domain.IPv6Suffix = valueValidator(effective.IPv6Suffix).interfaceID(effective.IPv6Suffix)
+
+		if domain.IPv6 != IPv6PrefixOnlyValue {
+			v.errorf(effective.IPv6Suffix, "An IPv6 suffix for %s requires %s=%s.", entry, IPv6EnvKey, IPv6PrefixOnlyValue)
+		}
+	}
+
+	if effective.IPv6SubnetID.isSet() {
+		domain.IPv6SubnetID = valueValidator(effective.IPv6SubnetID).subnetID(effective.IPv6SubnetID)
+
+		if domain.IPv6 != IPv6PrefixOnlyValue {
+			v.errorf(effective.IPv6SubnetID, "An IPv6 subnet ID for %s requires %s=%s.", entry, IPv6EnvKey, IPv6PrefixOnlyValue)
+		}
+	}
+
+	if !domain.IPv4 && domain.IPv6 == "false" {
+		v.errorf(effective.IPv4.or(effective.IPv6), "Both IPv4 and IPv6 updates are disabled for %s. No updates would be performed for it.", entry)
+	}
+
+	if domain.Credentials.APIKey == "" || domain.Credentials.SecretKey == "" {
+		v.errorf(fileDomain.Name, "No API key pair for %s. Set the environment variables %s and %s or apikey and secretkey in the configuration file.", entry, APIKeyEnvKey, SecretKeyEnvKey)
+	}
+
+	if domain.StrictOwnership && domain.Notes == "" {
+		v.errorf(effective.StrictOwnership, "Strict ownership of %s requires a non-empty ownership marker in %s or notes.", entry, NotesEnvKey)
+	}
+
+	return domain, true
+}
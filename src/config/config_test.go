@@ -0,0 +1,258 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeConfigFile writes content to a temporary configuration file and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "gorkbunddns.yaml")
+
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfigFile(t, `
+apikey: pk1_global
+secretkey: sk1_global
+ttl: 3600
+ipv6: prefix-only
+ipv4Sources: [http, fritzbox]
+domains:
+  - name: example.com
+  - name: vpn.example.com
+    ttl: 600
+    notes: managed by GorkbunDDNS
+    strictOwnership: true
+    ipv6: false
+  - name: example.org
+    ipv4: false
+    ipv6: host-ip
+    apikey: pk1_other
+    secretkey: sk1_other
+    multipleRecords: unify
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.TimeoutSeconds != defaultTimeoutSeconds || !slices.Equal(cfg.IPv4Sources, []string{"http", "fritzbox"}) || !slices.Equal(cfg.IPv6Sources, defaultSources) {
+		t.Errorf("unexpected global settings: %+v", cfg)
+	}
+	if len(cfg.Domains) != 3 {
+		t.Fatalf("expected 3 domains, got: %v", cfg.Domains)
+	}
+
+	vpn := cfg.Domains[1]
+	if vpn.TTL != 600 || vpn.Notes != "managed by GorkbunDDNS" || !vpn.StrictOwnership || vpn.Subdomain != "vpn" || vpn.RootDomain != "example.com" || !vpn.IPv4 || vpn.IPv6 != "false" {
+		t.Errorf("unexpected domain: %+v", vpn)
+	}
+
+	org := cfg.Domains[2]
+	if org.TTL != 3600 || org.Credentials.APIKey != "pk1_other" || org.MultipleRecords != MulRecordsUnifyValue || org.IPv4 || org.IPv6 != IPv6HostIPValue {
+		t.Errorf("unexpected domain: %+v", org)
+	}
+
+	if len(cfg.AllCredentials()) != 2 {
+		t.Errorf("expected 2 API key pairs, got: %v", cfg.AllCredentials())
+	}
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	path := writeConfigFile(t, `apikey: pk1_global
+secretkey: sk1_global
+timeout: 0
+domains:
+  - name: example
+  - name: example.com
+    ttl: abc
+  - name: vpn.example.com
+    strictOwnership: true
+`)
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expectedErrors := []string{
+		path + ":3: must be greater than 0.",
+		path + ":5: \"example\" is not a valid domain.",
+		path + ":7: must be a number.",
+		path + ":9: Strict ownership of vpn.example.com requires",
+	}
+
+	for _, expected := range expectedErrors {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected: %s, got: %s", expected, err)
+		}
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	path := writeConfigFile(t, "domains:\n  - name: example.com\n    tll: 60\n")
+
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), "tll") {
+		t.Errorf("expected an error about the unknown key, got: %v", err)
+	}
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, `
+apikey: pk1_file
+secretkey: sk1_file
+ttl: 600
+domains:
+  - name: example.com
+  - name: vpn.example.com
+    notes: from file
+`)
+
+	t.Setenv(APIKeyEnvKey, "pk1_env")
+	t.Setenv(TTLEnvKey, "3600")
+	t.Setenv(TTLPerDomainEnvKey, "vpn.example.com=900")
+	t.Setenv(DomainsEnvKey, "vpn.example.com,web.example.com")
+	t.Setenv(IPv6EnvKey, "")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Domains) != 2 {
+		t.Fatalf("expected 2 domains, got: %v", cfg.Domains)
+	}
+
+	vpn, web := cfg.Domains[0], cfg.Domains[1]
+	if vpn.TTL != 900 || vpn.Notes != "from file" || vpn.Credentials.APIKey != "pk1_env" {
+		t.Errorf("unexpected domain: %+v", vpn)
+	}
+	if web.TTL != 3600 || web.Notes != "" || web.Credentials.SecretKey != "sk1_file" {
+		t.Errorf("unexpected domain: %+v", web)
+	}
+	if vpn.IPv6 != "false" {
+		t.Errorf("expected: false, got: %s", vpn.IPv6)
+	}
+}
+
+func TestLoadModesPerDomain(t *testing.T) {
+	t.Setenv(DomainsEnvKey, "vpn.example.com,nas.example.com,web.example.com")
+	t.Setenv(APIKeyEnvKey, "pk1")
+	t.Setenv(SecretKeyEnvKey, "sk1")
+	t.Setenv(IPv6EnvKey, IPv6HostIPValue)
+	t.Setenv(IPv4PerDomainEnvKey, "nas.example.com=false,web.example.com=false")
+	t.Setenv(IPv6PerDomainEnvKey, "vpn.example.com=false,nas.example.com=prefix-only")
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		ipv4 bool
+		ipv6 string
+	}{
+		{true, "false"},
+		{false, IPv6PrefixOnlyValue},
+		{false, IPv6HostIPValue},
+	}
+
+	for i, domain := range cfg.Domains {
+		if domain.IPv4 != expected[i].ipv4 || domain.IPv6 != expected[i].ipv6 {
+			t.Errorf("expected: %t/%s, got: %t/%s for %s", expected[i].ipv4, expected[i].ipv6, domain.IPv4, domain.IPv6, domain.FQDN)
+		}
+	}
+}
+
+func TestLoadEnvOnly(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		expectedError string
+	}{
+		{"Valid", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1"}, ""},
+		{"NoDomains", map[string]string{APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1"}, "No domains configured."},
+		{"NoCredentials", map[string]string{DomainsEnvKey: "example.com"}, "No API key pair for example.com."},
+		{"UnusedTTLPerDomain", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", TTLPerDomainEnvKey: "example.org=600"}, "environment variable TTL_PER_DOMAIN: example.org is not a configured domain."},
+		{"TTLBelowMinimum", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", TTLPerDomainEnvKey: "example.com=60"}, "environment variable TTL_PER_DOMAIN: must be at least 600, the minimum TTL of Porkbun. Was: 60"},
+		{"BothDisabled", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv4EnvKey: "false"}, "environment variable IPV4: Both IPv4 and IPv6 updates are disabled for example.com."},
+		{"BothDisabledPerDomain", map[string]string{DomainsEnvKey: "example.com,vpn.example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv4PerDomainEnvKey: "vpn.example.com=false"}, "environment variable IPV4_PER_DOMAIN: Both IPv4 and IPv6 updates are disabled for vpn.example.com."},
+		{"IPv6Suffix", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv6EnvKey: IPv6PrefixOnlyValue, IPv6SuffixPerDomainEnvKey: "example.com=::211:32ff:fe12:3456"}, ""},
+		{"IPv6SuffixWithPrefix", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv6EnvKey: IPv6PrefixOnlyValue, IPv6SuffixPerDomainEnvKey: "example.com=2001:db8::1"}, "environment variable IPV6_SUFFIX_PER_DOMAIN: must be an IPv6 interface ID"},
+		{"IPv6SuffixWithoutPrefixOnly", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv6EnvKey: IPv6HostIPValue, IPv6SuffixPerDomainEnvKey: "example.com=::1"}, "An IPv6 suffix for example.com requires IPV6=prefix-only."},
+		{"IPv6SubnetID", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv6EnvKey: IPv6PrefixOnlyValue, IPv6SubnetIDPerDomainEnvKey: "example.com=1a"}, ""},
+		{"InvalidIPv6SubnetID", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv6EnvKey: IPv6PrefixOnlyValue, IPv6SubnetIDPerDomainEnvKey: "example.com=xyz"}, "environment variable IPV6_SUBNET_ID_PER_DOMAIN: must be a hexadecimal subnet ID"},
+		{"IPv4Sources", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv4SourcesEnvKey: "http, fritzbox"}, ""},
+		{"UnknownIPv4Source", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv4SourcesEnvKey: "http,router"}, "environment variable IPV4_SOURCES: Unknown IP source \"router\"."},
+		{"STUNServers", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv4SourcesEnvKey: "stun,http", STUNServersEnvKey: "stun.example.com:3478, [2001:db8::1]:3478"}, ""},
+		{"InvalidSTUNServer", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", STUNServersEnvKey: "stun.example.com"}, "environment variable STUN_SERVERS: must be a comma-separated list of host:port addresses. Invalid entry: stun.example.com"},
+		{"DNSQueries", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv6SourcesEnvKey: "dns", DNSQueriesEnvKey: "ip:myip.opendns.com@resolver1.opendns.com, txt:o-o.myaddr.l.google.com@[2001:4860:4802:32::a]:53"}, ""},
+		{"InvalidDNSQuery", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", DNSQueriesEnvKey: "cname:myip.opendns.com@resolver1.opendns.com"}, "environment variable DNS_QUERIES: Query type of \"cname:myip.opendns.com@resolver1.opendns.com\" must be ip or txt."},
+		{"Quorum", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv4SourcesEnvKey: "fritzbox,stun,dns", QuorumEnvKey: "2", CGNATEnvKey: CGNATWithdrawValue}, ""},
+		{"QuorumTooLarge", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", QuorumEnvKey: "3"}, "environment variable QUORUM: must not be greater than the number of sources in IPV4_SOURCES (2). Was: 3"},
+		{"InvalidCGNAT", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", CGNATEnvKey: "delete"}, "environment variable CGNAT: must be one of"},
+		{"FritzBox", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", FritzBoxHostEnvKey: "192.168.178.1", FritzBoxUsernameEnvKey: "ddns", FritzBoxPasswordEnvKey: "secret", FritzBoxHTTPSEnvKey: "true"}, ""},
+		{"InvalidFritzBoxHost", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", FritzBoxHostEnvKey: "http://fritz.box:49000"}, "environment variable FRITZBOX_HOST: must be a host name or IP address"},
+		{"DuplicateIPv6Source", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv6SourcesEnvKey: "http,http"}, "environment variable IPV6_SOURCES: contains http more than once."},
+		{"InvalidIPv6PerDomain", map[string]string{DomainsEnvKey: "example.com", APIKeyEnvKey: "pk1", SecretKeyEnvKey: "sk1", IPv6PerDomainEnvKey: "example.com=true"}, "environment variable IPV6_PER_DOMAIN: must be one of"},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			for key, value := range testcase.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := Load("")
+
+			if testcase.expectedError == "" && err != nil {
+				t.Errorf("expected no error, got: %s", err)
+			}
+			if testcase.expectedError != "" && (err == nil || !strings.Contains(err.Error(), testcase.expectedError)) {
+				t.Errorf("expected: %s, got: %v", testcase.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestLoadGlobalProblemReportedOnce(t *testing.T) {
+	path := writeConfigFile(t, `
+apikey: pk1
+secretkey: sk1
+ttl: abc
+domains:
+  - name: example.com
+  - name: vpn.example.com
+  - name: web.example.com
+    ttl: xyz
+`)
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if count := strings.Count(err.Error(), "must be a number"); count != 2 {
+		t.Errorf("expected the global and the domain TTL to be reported once each, got: %s", err)
+	}
+}
+
+func TestCredentialsString(t *testing.T) {
+	credentials := Credentials{APIKey: "pk1_0123456789abcdef", SecretKey: "sk1_0123456789abcdef"}
+
+	if s := credentials.String(); strings.Contains(s, "pk1") || strings.Contains(s, "0123") || len(s) != 9 {
+		t.Errorf("expected a short hash, got: %s", s)
+	}
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"bjoernblessin.de/gorkbunddns/src/util/assert"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// getSubAndRootDomain splits a fully qualified domain name into subdomain and root domain.
+// The root domain is the registrable domain according to the embedded Public Suffix List.
+// getSubAndRootDomain("sub.example.com") returns "sub" and "example.com".
+// getSubAndRootDomain("home.example.co.uk") returns "home" and "example.co.uk".
+func getSubAndRootDomain(fqdn string) (subdomain string, rootDomain string) {
+	registrableDomain, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(fqdn))
+	assert.IsNil(err, "fqdn should contain a registrable domain because it's checked in isFQDNValid()")
+
+	domainParts := strings.Split(fqdn, ".")
+	rootLabels := strings.Count(registrableDomain, ".") + 1
+
+	rootDomain = strings.Join(domainParts[len(domainParts)-rootLabels:], ".")
+	subdomain = strings.Join(domainParts[:len(domainParts)-rootLabels], ".")
+	return subdomain, rootDomain
+}
+
+// splitDomainEntry splits an entry of the DOMAINS environment variable into FQDN, subdomain and root domain.
+// An entry is either an FQDN ("home.example.co.uk"), whose root domain is determined by the Public Suffix List,
+// or a subdomain and root domain separated by "@" ("home@example.co.uk"), which overrides the Public Suffix List.
+// The root domain itself is written as "@example.co.uk".
+func splitDomainEntry(entry string) (fqdn string, subdomain string, rootDomain string) {
+	subdomain, rootDomain, explicit := strings.Cut(entry, "@")
+	if !explicit {
+		subdomain, rootDomain = getSubAndRootDomain(entry)
+		return entry, subdomain, rootDomain
+	}
+
+	if subdomain == "" {
+		return rootDomain, subdomain, rootDomain
+	}
+
+	return subdomain + "." + rootDomain, subdomain, rootDomain
+}
+
+// isDomainEntryValid checks if entry is a valid entry of the DOMAINS environment variable. See splitDomainEntry for the format.
+func isDomainEntryValid(entry string) bool {
+	subdomain, rootDomain, explicit := strings.Cut(entry, "@")
+	if !explicit {
+		return isFQDNValid(entry)
+	}
+
+	if !isFQDNValid(rootDomain) || strings.Contains(rootDomain, "@") {
+		return false
+	}
+
+	return subdomain == "" || isFQDNValid(subdomain+"."+rootDomain)
+}
+
+// isFQDNValid checks if fqdn is a valid fully qualified domain name in ASCII (punycode) form.
+// Every label must consist of 1 to 63 letters, digits, hyphens and underscores and must not start or end with a hyphen.
+// Only the first label may be the wildcard "*". The top-level domain must consist of at least 2 letters or be punycode ("xn--").
+// Also, fqdn must not be a public suffix (like "co.uk") itself.
+func isFQDNValid(fqdn string) bool {
+	if len(fqdn) > 253 {
+		return false
+	}
+
+	labels := strings.Split(fqdn, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for i, label := range labels {
+		if i == 0 && label == "*" {
+			continue
+		}
+
+		if !isLabelValid(label) {
+			return false
+		}
+	}
+
+	topLevelDomain := labels[len(labels)-1]
+	matched, err := regexp.MatchString("^([a-zA-Z]{2,}|xn--[a-zA-Z0-9-]+)$", topLevelDomain)
+	assert.IsNil(err)
+
+	if !matched {
+		return false
+	}
+
+	// The wildcard must cover subdomains of a registrable domain, not of a public suffix like "*.co.uk"
+	_, err = publicsuffix.EffectiveTLDPlusOne(strings.ToLower(strings.TrimPrefix(fqdn, "*.")))
+	return err == nil
+}
+
+// isLabelValid checks if label is a valid ASCII DNS label according to the LDH rule (RFC 1035, RFC 5891).
+// Underscores are allowed as well because they are common in record names like "_acme-challenge" or "_dmarc" (RFC 8552).
+func isLabelValid(label string) bool {
+	matched, err := regexp.MatchString("^[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?$", label)
+	assert.IsNil(err)
+
+	return matched
+}
+
+// toASCIIEntry converts an entry of the DOMAINS environment variable to ASCII (punycode) according to UTS #46 (IDNA2008).
+// For example, "büro.example.de" becomes "xn--bro-hoa.example.de". ASCII domains are only lowercased.
+// See splitDomainEntry for the format of entry.
+func toASCIIEntry(entry string) (string, error) {
+	subdomain, rootDomain, explicit := strings.Cut(entry, "@")
+	if !explicit {
+		return toASCIIFQDN(entry)
+	}
+
+	asciiRootDomain, err := toASCIIFQDN(rootDomain)
+	if err != nil || subdomain == "" {
+		return "@" + asciiRootDomain, err
+	}
+
+	asciiFQDN, err := toASCIIFQDN(subdomain + "." + rootDomain)
+	if err != nil {
+		return "", err
+	}
+
+	asciiSubdomain, found := strings.CutSuffix(asciiFQDN, "."+asciiRootDomain)
+	if !found {
+		return "", fmt.Errorf("%s is not a subdomain of %s after conversion to ASCII.", asciiFQDN, asciiRootDomain)
+	}
+
+	return asciiSubdomain + "@" + asciiRootDomain, nil
+}
+
+// lookupProfile is idna.Lookup without the STD3 rules, which would reject underscores. Other invalid characters are rejected by isLabelValid.
+var lookupProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// toASCIIFQDN converts fqdn to ASCII (punycode). A leading wildcard label "*" is kept as is.
+func toASCIIFQDN(fqdn string) (string, error) {
+	name, wildcard := strings.CutPrefix(fqdn, "*.")
+
+	asciiName, err := lookupProfile.ToASCII(name)
+	if err != nil {
+		return "", err
+	}
+
+	if wildcard {
+		return "*." + asciiName, nil
+	}
+
+	return asciiName, nil
+}
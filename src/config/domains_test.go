@@ -0,0 +1,140 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetSubAndRootDomain(t *testing.T) {
+	tests := []struct {
+		fqdn         string
+		expectedSub  string
+		expectedRoot string
+	}{
+		{"sub.example.com", "sub", "example.com"},
+		{"example.com", "", "example.com"},
+		{"sub.sub.example.com", "sub.sub", "example.com"},
+		{"*.example.com", "*", "example.com"},
+		{"home.example.co.uk", "home", "example.co.uk"},
+		{"example.co.uk", "", "example.co.uk"},
+		{"a.b.example.com.au", "a.b", "example.com.au"},
+		{"Sub.Example.CO.UK", "Sub", "Example.CO.UK"},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.fqdn, func(t *testing.T) {
+			sub, root := getSubAndRootDomain(testcase.fqdn)
+			if sub != testcase.expectedSub || root != testcase.expectedRoot {
+				t.Errorf("sub: %s, root: %s", sub, root)
+			}
+			// assert.Assert(testcase.expectedSub == sub, t)
+			// assert.Assert(testcase.expectedRoot == root, t)
+		})
+	}
+}
+
+func TestIsFQDNValid(t *testing.T) {
+	tests := []struct {
+		fqdn     string
+		expected bool
+	}{
+		{"example.de", true},
+		{"sub.example.com", true},
+		{"*.example.com", true},
+		{"*.com", false},
+		{"*.co.uk", false},
+		{"example", false},
+		{"example.c", false},
+		{"example..com", false},
+		{"co.uk", false},
+		{"com.au", false},
+		{"example.co.uk", true},
+		{"xn--bro-hoa.example.de", true},
+		{"example.xn--p1ai", true},
+		{"-example.com", false},
+		{"example-.com", false},
+		{"sub.*.example.com", false},
+		{"ex_ample.com", true},
+		{"_acme.example.com", true},
+		{"_dmarc.sub.example.com", true},
+		{"example.co_m", false},
+		{"example.123", false},
+		{strings.Repeat("a", 64) + ".example.com", false},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.fqdn, func(t *testing.T) {
+			result := isFQDNValid(testcase.fqdn)
+			if result != testcase.expected {
+				t.Errorf("expected: %t, got: %t", testcase.expected, result)
+			}
+			// assert.Assert(testcase.expected == result, t)
+		})
+	}
+}
+
+func TestToASCIIEntry(t *testing.T) {
+	tests := []struct {
+		entry    string
+		expected string
+		valid    bool
+	}{
+		{"example.com", "example.com", true},
+		{"Sub.Example.COM", "sub.example.com", true},
+		{"büro.example.de", "xn--bro-hoa.example.de", true},
+		{"*.büro.de", "*.xn--bro-hoa.de", true},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai", true},
+		{"home@bücher.co.uk", "home@xn--bcher-kva.co.uk", true},
+		{"bür.o@example.de", "xn--br-xka.o@example.de", true},
+		{"@münchen.de", "@xn--mnchen-3ya.de", true},
+		{"_acme.Example.com", "_acme.example.com", true},
+		{"exa mple.com", "", false},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.entry, func(t *testing.T) {
+			result, err := toASCIIEntry(testcase.entry)
+			valid := err == nil && isDomainEntryValid(result)
+			if valid != testcase.valid {
+				t.Fatalf("expected valid: %t, got: %t (%s, %v)", testcase.valid, valid, result, err)
+			}
+			if valid && result != testcase.expected {
+				t.Errorf("expected: %s, got: %s", testcase.expected, result)
+			}
+		})
+	}
+}
+
+func TestSplitDomainEntry(t *testing.T) {
+	tests := []struct {
+		entry        string
+		valid        bool
+		expectedFQDN string
+		expectedSub  string
+		expectedRoot string
+	}{
+		{"home.example.co.uk", true, "home.example.co.uk", "home", "example.co.uk"},
+		{"home@example.co.uk", true, "home.example.co.uk", "home", "example.co.uk"},
+		{"@example.co.uk", true, "example.co.uk", "", "example.co.uk"},
+		{"a.b@myname.example.com", true, "a.b.myname.example.com", "a.b", "myname.example.com"},
+		{"home@co.uk", false, "", "", ""},
+		{"home@example", false, "", "", ""},
+		{"a@b@example.com", false, "", "", ""},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.entry, func(t *testing.T) {
+			if isDomainEntryValid(testcase.entry) != testcase.valid {
+				t.Fatalf("expected valid: %t", testcase.valid)
+			}
+			if !testcase.valid {
+				return
+			}
+
+			fqdn, sub, root := splitDomainEntry(testcase.entry)
+			if fqdn != testcase.expectedFQDN || sub != testcase.expectedSub || root != testcase.expectedRoot {
+				t.Errorf("fqdn: %s, sub: %s, root: %s", fqdn, sub, root)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package porkbun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Error kinds of the Porkbun API. Use [errors.Is] to check which kind an error returned by a [Client] is.
+var (
+	ErrInvalidCredentials = errors.New("invalid API key or secret API key")
+	ErrAPIAccessDisabled  = errors.New("API access is not enabled for the domain")
+	ErrRateLimited        = errors.New("rate limited by the Porkbun server")
+	ErrInvalidRecord      = errors.New("invalid record")
+	ErrServerUnavailable  = errors.New("Porkbun server unavailable")
+)
+
+// ErrInvalidResponse is wrapped by errors of responses that couldn't be decoded. The request may have been processed anyway.
+var ErrInvalidResponse = errors.New("invalid response of the Porkbun server")
+
+// Error is a failed response of the Porkbun server.
+// The Porkbun server always responds with {"status":"ERROR","message":"..."} on failure.
+type Error struct {
+	// Path is the API endpoint that was requested, e.g. "/dns/create/example.com".
+	Path string
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Message is the message sent by the Porkbun server. It may be empty, e.g. if a proxy in between responded.
+	Message string
+	// Kind is one of the ErrXxx variables or nil if the error couldn't be classified.
+	Kind error
+	// RetryAfter is the delay requested by the Retry-After header or 0 if there was none.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	message := e.Message
+	if message == "" {
+		message = http.StatusText(e.StatusCode)
+	}
+
+	if e.Kind == nil {
+		return fmt.Sprintf("Porkbun server responded to %s with %d: %s", e.Path, e.StatusCode, message)
+	}
+
+	return fmt.Sprintf("Porkbun server responded to %s with %d (%s): %s", e.Path, e.StatusCode, e.Kind, message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// IsTransient reports whether err is likely temporary, so that the same request may succeed later.
+// Errors that aren't a Porkbun [Error], e.g. network errors, are considered transient, except for [ErrInvalidResponse].
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, ErrInvalidResponse) {
+		return false
+	}
+
+	var porkbunErr *Error
+	if !errors.As(err, &porkbunErr) {
+		return true
+	}
+
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServerUnavailable)
+}
+
+// isUnprocessed reports whether the request that failed with err provably wasn't processed by the Porkbun server,
+// so that even a request that isn't idempotent may be repeated.
+// This is the case if no connection could be established or if the server explicitly refused with 429 or 503.
+func isUnprocessed(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var porkbunErr *Error
+	if !errors.As(err, &porkbunErr) {
+		return false
+	}
+
+	return porkbunErr.StatusCode == http.StatusTooManyRequests || porkbunErr.StatusCode == http.StatusServiceUnavailable
+}
+
+// retryAfterOf returns the RetryAfter of err if err is an [Error].
+func retryAfterOf(err error) time.Duration {
+	var porkbunErr *Error
+	if !errors.As(err, &porkbunErr) {
+		return 0
+	}
+
+	return porkbunErr.RetryAfter
+}
+
+// newError decodes the response body of a failed request into an [Error].
+func newError(path string, statusCode int, retryAfter time.Duration, responseBody []byte) *Error {
+	var response struct {
+		Message string `json:"message"`
+	}
+	err := json.Unmarshal(responseBody, &response)
+	if err != nil {
+		// Not a Porkbun response, e.g. an HTML error page of a proxy
+		response.Message = ""
+	}
+
+	return &Error{
+		Path:       path,
+		StatusCode: statusCode,
+		Message:    response.Message,
+		Kind:       classifyError(path, statusCode, response.Message),
+		RetryAfter: retryAfter,
+	}
+}
+
+// classifyError maps a failed response to one of the ErrXxx variables.
+// Porkbun has no error codes, so the message is matched against known texts.
+func classifyError(path string, statusCode int, message string) error {
+	lowerMessage := strings.ToLower(message)
+
+	switch {
+	case statusCode == http.StatusTooManyRequests || strings.Contains(lowerMessage, "rate limit"):
+		return ErrRateLimited
+	case statusCode >= 500:
+		return ErrServerUnavailable
+	case statusCode == http.StatusUnauthorized || strings.Contains(lowerMessage, "api key"):
+		return ErrInvalidCredentials
+	case strings.Contains(lowerMessage, "api access") || strings.Contains(lowerMessage, "opted in"):
+		return ErrAPIAccessDisabled
+	case strings.HasPrefix(path, "/dns/create/") || strings.HasPrefix(path, "/dns/edit/"):
+		// E.g. "Invalid record content." or "Edit error: We were unable to edit the DNS record."
+		return ErrInvalidRecord
+	default:
+		return nil
+	}
+}
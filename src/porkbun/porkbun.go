@@ -0,0 +1,268 @@
+package porkbun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bjoernblessin.de/gorkbunddns/src/shared"
+	"bjoernblessin.de/gorkbunddns/src/util/assert"
+	"bjoernblessin.de/gorkbunddns/src/util/logger"
+)
+
+// DefaultBaseURL is the base URL of the official Porkbun API v3.
+const DefaultBaseURL = "https://api.porkbun.com/api/json/v3"
+
+// Client talks to the Porkbun API on behalf of one API key pair.
+// A Client is safe for concurrent use and should be reused to benefit from keep-alive connections.
+type Client struct {
+	baseURL     string
+	httpClient  *http.Client
+	credentials shared.RequestCredentials
+	retryPolicy RetryPolicy
+}
+
+// NewClient creates a Client sending requests to baseURL (e.g. [DefaultBaseURL]) with httpClient.
+// If httpClient is nil, [http.DefaultClient] is used.
+func NewClient(baseURL string, httpClient *http.Client, apikey string, secretkey string) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		httpClient:  httpClient,
+		credentials: shared.RequestCredentials{SecretAPIKey: secretkey, APIKey: apikey},
+		retryPolicy: DefaultRetryPolicy,
+	}
+}
+
+// SetRetryPolicy replaces the [DefaultRetryPolicy] of c. It must not be called concurrently with requests.
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.retryPolicy = policy
+}
+
+// Record is a DNS record as returned by the Porkbun API.
+// Name is the fully qualified name of the record, e.g. "sub.example.com".
+type Record struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	TTL     string `json:"ttl"`
+	Prio    string `json:"prio"`
+	Notes   string `json:"notes"`
+}
+
+// RecordParams describes a record that should be created or how an existing record should be changed.
+// Name is the subdomain part only, e.g. "sub" for "sub.example.com". It's empty for the root domain.
+//
+// Valid Types are "A", "MX", "CNAME", "ALIAS", "TXT", "NS", "AAAA", "SRV", "TLSA", "CAA", "HTTPS", "SVCB".
+type RecordParams struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	// TTL in seconds. 0 omits the TTL, so Porkbun's default is used.
+	TTL int `json:"ttl,omitempty,string"`
+	// Notes are shown in the Porkbun WebGUI. Empty omits the notes.
+	Notes string `json:"notes,omitempty"`
+}
+
+// Ping checks the API key pair and returns the IP address the request originated from.
+func (c *Client) Ping(ctx context.Context) (yourIP string, err error) {
+	var response struct {
+		YourIP string `json:"yourIp"`
+	}
+
+	err = c.post(ctx, "/ping", c.credentials, &response)
+	if err != nil {
+		return "", err
+	}
+
+	return response.YourIP, nil
+}
+
+// Domain is a domain of the Porkbun account as returned by the domain listing.
+type Domain struct {
+	Domain string `json:"domain"`
+	Status string `json:"status"`
+}
+
+// listAllPageSize is the number of domains the Porkbun server returns per page of the domain listing.
+const listAllPageSize = 1000
+
+// ListDomains gets all domains of the Porkbun account.
+func (c *Client) ListDomains(ctx context.Context) ([]Domain, error) {
+	type listAllRequest struct {
+		shared.RequestCredentials
+		Start string `json:"start"`
+	}
+
+	var domains []Domain
+
+	for {
+		var response struct {
+			Domains []Domain `json:"domains"`
+		}
+
+		err := c.post(ctx, "/domain/listAll", listAllRequest{RequestCredentials: c.credentials, Start: strconv.Itoa(len(domains))}, &response)
+		if err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, response.Domains...)
+
+		if len(response.Domains) < listAllPageSize {
+			return domains, nil
+		}
+	}
+}
+
+// RetrieveByNameType gets all records of rootDomain matching subdomain and recordType.
+// There may be zero, one, or multiple records, each with different content.
+func (c *Client) RetrieveByNameType(ctx context.Context, rootDomain string, recordType string, subdomain string) ([]Record, error) {
+	var response struct {
+		Records []Record `json:"records"`
+	}
+
+	err := c.post(ctx, fmt.Sprintf("/dns/retrieveByNameType/%s/%s/%s", rootDomain, recordType, subdomain), c.credentials, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Records, nil
+}
+
+// Retrieve gets all records of rootDomain.
+func (c *Client) Retrieve(ctx context.Context, rootDomain string) ([]Record, error) {
+	var response struct {
+		Records []Record `json:"records"`
+	}
+
+	err := c.post(ctx, fmt.Sprintf("/dns/retrieve/%s", rootDomain), c.credentials, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Records, nil
+}
+
+// Create creates a new record for rootDomain and returns the ID of the new record.
+func (c *Client) Create(ctx context.Context, rootDomain string, params RecordParams) (id string, err error) {
+	var response struct {
+		ID json.Number `json:"id"`
+	}
+
+	// Not idempotent, a repeated request after a lost response would create a duplicate record
+	err = c.postWithRetry(ctx, fmt.Sprintf("/dns/create/%s", rootDomain), c.recordRequest(params), &response, false)
+	if err != nil {
+		return "", err
+	}
+
+	return response.ID.String(), nil
+}
+
+// Edit changes the record of rootDomain matching id according to params.
+func (c *Client) Edit(ctx context.Context, rootDomain string, id string, params RecordParams) error {
+	return c.post(ctx, fmt.Sprintf("/dns/edit/%s/%s", rootDomain, id), c.recordRequest(params), nil)
+}
+
+// Delete removes the record of rootDomain matching id.
+func (c *Client) Delete(ctx context.Context, rootDomain string, id string) error {
+	return c.post(ctx, fmt.Sprintf("/dns/delete/%s/%s", rootDomain, id), c.credentials, nil)
+}
+
+type recordRequest struct {
+	shared.RequestCredentials
+	RecordParams
+}
+
+func (c *Client) recordRequest(params RecordParams) recordRequest {
+	return recordRequest{RequestCredentials: c.credentials, RecordParams: params}
+}
+
+// post sends an idempotent POST request with requestBody encoded as JSON to path.
+// Transient failures are retried according to the retry policy of c.
+// If response is non-nil, the JSON response body is decoded into it.
+func (c *Client) post(ctx context.Context, path string, requestBody any, response any) error {
+	return c.postWithRetry(ctx, path, requestBody, response, true)
+}
+
+// postWithRetry is like post but only repeats requests that aren't idempotent if the server provably didn't process them.
+func (c *Client) postWithRetry(ctx context.Context, path string, requestBody any, response any, idempotent bool) error {
+	jsonBody, err := json.Marshal(requestBody)
+	assert.IsNil(err)
+
+	maxAttempts := max(c.retryPolicy.MaxAttempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		err = c.postOnce(ctx, path, jsonBody, response)
+
+		delay, retry := c.retryPolicy.nextDelay(attempt, err, idempotent)
+		if !retry {
+			return err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			// E.g. a Retry-After header asking for longer than the caller is willing to wait
+			return err
+		}
+
+		logger.Warnf("Attempt %d/%d of request to %s failed, retrying in %s. %s", attempt, maxAttempts, path, delay.Round(time.Millisecond), err)
+
+		if sleepErr := sleep(ctx, delay); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// postOnce sends a single POST request with jsonBody to path.
+func (c *Client) postOnce(ctx context.Context, path string, jsonBody []byte, response any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(jsonBody))
+	assert.IsNil(err)
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("Request to %s failed. %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Reading response of %s failed. %w", path, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return newError(path, resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), responseBody)
+	}
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	err = json.Unmarshal(responseBody, &status)
+	if err != nil {
+		return fmt.Errorf("Porkbun server returned invalid JSON format for %s (%w). %w", path, ErrInvalidResponse, err)
+	}
+
+	if status.Status != "SUCCESS" {
+		return newError(path, resp.StatusCode, 0, responseBody)
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(responseBody, response)
+	if err != nil {
+		return fmt.Errorf("Porkbun server returned invalid JSON format for %s (%w). %w", path, ErrInvalidResponse, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package porkbun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientRequests(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotBody = nil
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+
+		switch r.URL.Path {
+		case "/ping":
+			w.Write([]byte(`{"status":"SUCCESS","yourIp":"203.0.113.1"}`))
+		case "/dns/retrieveByNameType/example.com/A/sub":
+			w.Write([]byte(`{"status":"SUCCESS","records":[{"id":"1","name":"sub.example.com","type":"A","content":"203.0.113.2","ttl":"600","prio":"0","notes":""}]}`))
+		case "/dns/create/example.com":
+			w.Write([]byte(`{"status":"SUCCESS","id":106926659}`))
+		default:
+			w.Write([]byte(`{"status":"SUCCESS"}`))
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/", server.Client(), "pk1_test", "sk1_test")
+	ctx := context.Background()
+
+	yourIP, err := client.Ping(ctx)
+	if err != nil || yourIP != "203.0.113.1" {
+		t.Errorf("Ping: ip: %s, err: %v", yourIP, err)
+	}
+	if gotBody["apikey"] != "pk1_test" || gotBody["secretapikey"] != "sk1_test" {
+		t.Errorf("credentials missing in request body: %v", gotBody)
+	}
+
+	records, err := client.RetrieveByNameType(ctx, "example.com", "A", "sub")
+	if err != nil || len(records) != 1 || records[0].ID != "1" || records[0].Content != "203.0.113.2" {
+		t.Errorf("RetrieveByNameType: records: %v, err: %v", records, err)
+	}
+
+	id, err := client.Create(ctx, "example.com", RecordParams{Name: "sub", Type: "A", Content: "203.0.113.3"})
+	if err != nil || id != "106926659" {
+		t.Errorf("Create: id: %s, err: %v", id, err)
+	}
+	if gotBody["name"] != "sub" || gotBody["type"] != "A" || gotBody["content"] != "203.0.113.3" || gotBody["apikey"] != "pk1_test" {
+		t.Errorf("unexpected create request body: %v", gotBody)
+	}
+
+	err = client.Edit(ctx, "example.com", "1", RecordParams{Name: "sub", Type: "A", Content: "203.0.113.4"})
+	if err != nil || gotPath != "/dns/edit/example.com/1" {
+		t.Errorf("Edit: path: %s, err: %v", gotPath, err)
+	}
+
+	err = client.Delete(ctx, "example.com", "1")
+	if err != nil || gotPath != "/dns/delete/example.com/1" {
+		t.Errorf("Delete: path: %s, err: %v", gotPath, err)
+	}
+}
+
+func TestClientNonOKStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"ERROR","message":"Invalid API key. (002)"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, server.Client(), "pk1_test", "sk1_test")
+
+	_, err := client.Ping(context.Background())
+	if err == nil {
+		t.Errorf("expected error for non-OK status")
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		statusCode    int
+		body          string
+		expectedKind  error
+		expectedRetry bool
+	}{
+		{"InvalidCredentials", "/ping", 400, `{"status":"ERROR","message":"Invalid API key. (002)"}`, ErrInvalidCredentials, false},
+		{"APIAccessDisabled", "/dns/retrieveByNameType/example.com/A/sub", 400, `{"status":"ERROR","message":"Domain is not opted in to API access."}`, ErrAPIAccessDisabled, false},
+		{"RateLimited", "/dns/retrieveByNameType/example.com/A/sub", 429, `{"status":"ERROR","message":"Too many requests."}`, ErrRateLimited, true},
+		{"InvalidRecord", "/dns/create/example.com", 400, `{"status":"ERROR","message":"Invalid record content."}`, ErrInvalidRecord, false},
+		{"ServerUnavailable", "/dns/edit/example.com/1", 503, `<html>503 Service Temporarily Unavailable</html>`, ErrServerUnavailable, true},
+		{"ErrorWithStatusOK", "/dns/delete/example.com/1", 200, `{"status":"ERROR","message":"Something went wrong."}`, nil, false},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(testcase.statusCode)
+				w.Write([]byte(testcase.body))
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL, server.Client(), "pk1_test", "sk1_test")
+			client.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+			err := client.post(context.Background(), testcase.path, client.credentials, nil)
+
+			var porkbunErr *Error
+			if !errors.As(err, &porkbunErr) {
+				t.Fatalf("expected *Error, got: %v", err)
+			}
+			if porkbunErr.Kind != testcase.expectedKind {
+				t.Errorf("expected kind: %v, got: %v", testcase.expectedKind, porkbunErr.Kind)
+			}
+			if IsTransient(err) != testcase.expectedRetry {
+				t.Errorf("expected transient: %t, got: %t", testcase.expectedRetry, IsTransient(err))
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package porkbun
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how often and how fast failed requests are repeated.
+// Only transient errors (see [IsTransient]) are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts per request including the first one. Values below 1 are treated as 1.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles with each further retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential delay between two attempts. A Retry-After header asking for a longer delay is honored anyway, unless it exceeds the deadline of the context.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used by every [Client] unless [Client.SetRetryPolicy] is called.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 4, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// backoff returns the delay before the retry following the failed attempt (1-based).
+// The delay grows exponentially and is randomized between 50% and 100% (jitter) so that multiple instances don't retry in lockstep.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxDelay)
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// nextDelay returns how long to wait after the failed attempt and whether another attempt should be made at all.
+// Requests that aren't idempotent are only repeated if the server provably didn't process them (see [isUnprocessed]).
+func (p RetryPolicy) nextDelay(attempt int, err error, idempotent bool) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts || !IsTransient(err) || (!idempotent && !isUnprocessed(err)) {
+		return 0, false
+	}
+
+	return max(p.backoff(attempt), retryAfterOf(err)), true
+}
+
+// sleep waits for delay or until ctx is done. It returns ctx.Err() if ctx is done first.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an HTTP date.
+// It returns 0 if the value is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+
+	date, err := http.ParseTime(value)
+	if err == nil {
+		return max(date.Sub(now), 0)
+	}
+
+	return 0
+}
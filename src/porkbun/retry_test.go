@@ -0,0 +1,228 @@
+package porkbun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryTransientErrors(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         int
+		statusCode       int
+		maxAttempts      int
+		expectedRequests int
+		expectedErr      error
+	}{
+		{"RecoversFromServerError", 2, http.StatusServiceUnavailable, 4, 3, nil},
+		{"RecoversFromRateLimit", 1, http.StatusTooManyRequests, 4, 2, nil},
+		{"GivesUpAfterMaxAttempts", 10, http.StatusBadGateway, 3, 3, ErrServerUnavailable},
+		{"NoRetryOnPermanentError", 10, http.StatusBadRequest, 4, 1, ErrInvalidCredentials},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= testcase.failures {
+					w.WriteHeader(testcase.statusCode)
+					w.Write([]byte(`{"status":"ERROR","message":"Invalid API key. (002)"}`))
+					return
+				}
+				w.Write([]byte(`{"status":"SUCCESS","yourIp":"203.0.113.1"}`))
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL, server.Client(), "pk1_test", "sk1_test")
+			client.SetRetryPolicy(RetryPolicy{MaxAttempts: testcase.maxAttempts, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+
+			_, err := client.Ping(context.Background())
+			if !errors.Is(err, testcase.expectedErr) || (testcase.expectedErr == nil && err != nil) {
+				t.Errorf("expected error: %v, got: %v", testcase.expectedErr, err)
+			}
+			if requests != testcase.expectedRequests {
+				t.Errorf("expected requests: %d, got: %d", testcase.expectedRequests, requests)
+			}
+		})
+	}
+}
+
+func TestRetryAfterBeyondMaxDelay(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"status":"SUCCESS","yourIp":"203.0.113.1"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, server.Client(), "pk1_test", "sk1_test")
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+
+	start := time.Now()
+	_, err := client.Ping(context.Background())
+	if err != nil || requests != 2 {
+		t.Errorf("requests: %d, err: %v", requests, err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected to wait for the Retry-After delay of 1s, waited: %s", elapsed)
+	}
+}
+
+func TestRetryAfterBeyondDeadline(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "86400")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, server.Client(), "pk1_test", "sk1_test")
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Waiting a day would exceed the deadline, so the request gives up immediately
+	start := time.Now()
+	_, err := client.Ping(ctx)
+	if !errors.Is(err, ErrRateLimited) || requests.Load() != 1 {
+		t.Errorf("requests: %d, err: %v", requests.Load(), err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected to give up before the deadline, waited: %s", elapsed)
+	}
+}
+
+func TestRetryCreate(t *testing.T) {
+	tests := []struct {
+		name             string
+		failure          func(w http.ResponseWriter)
+		expectedRequests int
+	}{
+		{"RetriesRateLimit", func(w http.ResponseWriter) { w.WriteHeader(http.StatusTooManyRequests) }, 2},
+		{"RetriesServiceUnavailable", func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) }, 2},
+		// The record may have been created despite the error
+		{"NoRetryOnGatewayTimeout", func(w http.ResponseWriter) { w.WriteHeader(http.StatusGatewayTimeout) }, 1},
+		{"NoRetryOnInvalidJSON", func(w http.ResponseWriter) { w.Write([]byte(`{"status":"SUCCESS","id":`)) }, 1},
+		{"NoRetryOnTimeout", func(w http.ResponseWriter) { time.Sleep(100 * time.Millisecond) }, 1},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			// The handler of a timed out request may still be running when Create returns
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) == 1 {
+					testcase.failure(w)
+					return
+				}
+				w.Write([]byte(`{"status":"SUCCESS","id":123}`))
+			}))
+			defer server.Close()
+
+			httpClient := server.Client()
+			httpClient.Timeout = 50 * time.Millisecond
+
+			client := NewClient(server.URL, httpClient, "pk1_test", "sk1_test")
+			client.SetRetryPolicy(RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+
+			_, err := client.Create(context.Background(), "example.com", RecordParams{Type: "A", Content: "203.0.113.1"})
+			if int(requests.Load()) != testcase.expectedRequests {
+				t.Errorf("expected requests: %d, got: %d (err: %v)", testcase.expectedRequests, requests.Load(), err)
+			}
+		})
+	}
+}
+
+type roundTripperFunc func(request *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func TestRetryCreateUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"SUCCESS","id":123}`))
+	}))
+	defer server.Close()
+
+	// The first connection attempt fails, so the request provably never reached the server and is repeated
+	requests := 0
+	transport := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		requests++
+		if requests == 1 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+		}
+		return server.Client().Transport.RoundTrip(request)
+	})
+
+	client := NewClient(server.URL, &http.Client{Transport: transport}, "pk1_test", "sk1_test")
+	client.SetRetryPolicy(RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+
+	id, err := client.Create(context.Background(), "example.com", RecordParams{Type: "A", Content: "203.0.113.1"})
+	if err != nil || id != "123" || requests != 2 {
+		t.Errorf("requests: %d, id: %s, err: %v", requests, id, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{9, 10 * time.Second},
+	}
+
+	for _, testcase := range tests {
+		delay := policy.backoff(testcase.attempt)
+		if delay < testcase.expected/2 || delay > testcase.expected {
+			t.Errorf("attempt %d: expected delay between %s and %s, got: %s", testcase.attempt, testcase.expected/2, testcase.expected, delay)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"-5", 0},
+		{"Wed, 01 Jan 2025 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 01 Jan 2025 11:00:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.value, func(t *testing.T) {
+			result := parseRetryAfter(testcase.value, now)
+			if result != testcase.expected {
+				t.Errorf("expected: %s, got: %s", testcase.expected, result)
+			}
+		})
+	}
+}
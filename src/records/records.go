@@ -1,325 +1,592 @@
 package records
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
-	"os"
-	"regexp"
+	"strconv"
 	"strings"
 
-	"bjoernblessin.de/gorkbunddns/src/shared"
+	"bjoernblessin.de/gorkbunddns/src/config"
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
 	"bjoernblessin.de/gorkbunddns/src/util/assert"
-	"bjoernblessin.de/gorkbunddns/src/util/env"
 	"bjoernblessin.de/gorkbunddns/src/util/logger"
 	"bjoernblessin.de/gorkbunddns/src/wanip"
 )
 
-const DomainsEnvKey = "DOMAINS"
-const mulRecordsEnvKey = "MULTIPLE_RECORDS"
-const mulRecordsUnifyValue = "unify"
-const IPv4EnvKey = "IPV4"
-const IPv6EnvKey = "IPV6"
-const IPv6PrefixOnlyValue = "prefix-only"
-const IPv6HostIPValue = "host-ip"
-const IPv6FritzBoxIPValue = "fritzbox-ip"
-
-func Update(apikey string, secretkey string) {
-	domainsString, present := os.LookupEnv(DomainsEnvKey)
-	assert.Assert(present, "env should be present here because it's checked in main.validateEnvironment()")
-
-	domains := strings.Split(domainsString, ",")
-
-	IPv4Value, IPv4ValuePresent := env.ReadOptionalEnv(IPv4EnvKey)
-	var currentIPv4 string
-	var IPv4Err error
-
-	if IPv4Value == "true" || !IPv4ValuePresent {
-		// Either user set IPV4=true or he didn't set it at all (standard value)
-		currentIPv4, IPv4Err = wanip.GetFromFritzBox("ipv4")
-		if IPv4Err != nil {
-			logger.Warnf("Retrieving current WAN IPv4 via FRITZ!Box failed.")
+// Updater brings the A- and AAAA-Records of all configured domains up to date with the current IPs.
+// It remembers the IPs of the previous update to detect changes.
+type Updater struct {
+	cfg     *config.Config
+	clients map[config.Credentials]*porkbun.Client
+	// chains maps the IP sources used by the domains, e.g. ipv4Source, to the wanip sources asked for them.
+	chains map[string]wanip.Chain
+	// fritzBox provides the delegated IPv6 prefix for config.IPv6PrefixOnlyValue.
+	fritzBox *wanip.FritzBox
+	fetch    func(ctx context.Context, source string) (string, error)
+	// sweptIPs maps each zone to the IPs of the IP sources its records were last swept for.
+	sweptIPs map[zoneID]map[string]string
+}
+
+// NewUpdater creates an Updater for cfg. clients must contain a client for every API key pair of cfg.
+func NewUpdater(cfg *config.Config, clients map[config.Credentials]*porkbun.Client) *Updater {
+	u := &Updater{cfg: cfg, clients: clients, chains: map[string]wanip.Chain{}, sweptIPs: map[zoneID]map[string]string{}}
+	u.fetch = u.fetchIP
+
+	chainNames := map[string]struct {
+		family wanip.Family
+		names  []string
+		quorum int
+	}{
+		ipv4Source:                 {wanip.IPv4, cfg.IPv4Sources, cfg.Quorum},
+		config.IPv6WANIPValue:      {wanip.IPv6, cfg.IPv6Sources, cfg.Quorum},
+		config.IPv6FritzBoxIPValue: {wanip.IPv6, []string{wanip.FritzBoxSourceName}, 1},
+		config.IPv6HostIPValue:     {wanip.IPv6, []string{wanip.HTTPSourceName}, 1},
+	}
+
+	options := wanip.Options{
+		FritzBoxHost:     cfg.FritzBoxHost,
+		FritzBoxUsername: cfg.FritzBoxUsername,
+		FritzBoxPassword: cfg.FritzBoxPassword,
+		FritzBoxHTTPS:    cfg.FritzBoxHTTPS,
+		STUNServers:      cfg.STUNServers,
+		DNSQueries:       cfg.DNSQueries,
+		Interface:        cfg.Interface,
+	}
+	if credentials := cfg.AllCredentials(); len(credentials) > 0 {
+		// Any API key pair works for pinging Porkbun
+		options.PorkbunAPIURL = cfg.APIURL
+		options.PorkbunAPIKey = credentials[0].APIKey
+		options.PorkbunSecretKey = credentials[0].SecretKey
+	}
+
+	for source, chainName := range chainNames {
+		chain, err := wanip.NewChain(chainName.family, chainName.names, options)
+		assert.IsNil(err, "the configured IP sources should be validated by the config package")
+
+		if chainName.quorum > 1 {
+			chain.SetQuorum(chainName.quorum)
 		}
+
+		u.chains[source] = chain
 	}
 
-	IPv6Value, _ := env.ReadOptionalEnv(IPv6EnvKey)
-	var currentFritzboxIPv6, currentHostIPv6, currentIPv6Prefix string
-	var IPv6Err error
+	u.fritzBox = wanip.NewFritzBox(options)
 
-	if IPv6Value == IPv6FritzBoxIPValue {
-		// The user set IPV6=fritzbox-ip explicitly
-		currentFritzboxIPv6, IPv6Err = wanip.GetFromFritzBox("ipv6")
-		if IPv6Err != nil {
-			logger.Warnf("Retrieving current WAN IPv6 of FRITZ!Box failed.")
+	return u
+}
+
+// Update brings the records up to date with the current IPs.
+// Each IP source is queried at most once and only if at least one domain needs it.
+// In sweep mode all other records of the zones pointing to a previous IP are rewritten afterwards.
+func (u *Updater) Update(ctx context.Context) {
+	ips := newCurrentIPs(u.fetch)
+	zones := groupByRootDomain(u.cfg.Domains, u.clients)
+	// Records of each zone and whether their retrieval succeeded
+	allZoneRecords := make([][]porkbun.Record, len(zones))
+	retrieved := make([]bool, len(zones))
+
+	for i, zone := range zones {
+		// One request per root domain instead of one per FQDN and record type
+		zoneRecords, err := zone.client.Retrieve(ctx, zone.rootDomain)
+		if err != nil {
+			logRetrievalError(err, zone.rootDomain)
+			continue
 		}
-	} else if IPv6Value == IPv6HostIPValue {
-		// The user set IPV6=host-ip explicitly
-		currentHostIPv6, IPv6Err = wanip.GetGlobalUnicastIPv6()
-		if IPv6Err != nil {
-			logger.Warnf("Retrieving current host IPv6 failed. Is the host running on a (Docker) network with IPv6 support?")
+		allZoneRecords[i] = zoneRecords
+		retrieved[i] = true
+
+		for _, domain := range zone.domains {
+			if domain.IPv4 {
+				currentIPv4, err := ips.get(ctx, ipv4Source)
+				switch {
+				case err == nil:
+					tryUpdateRecordWithConstIP(ctx, zone.client, filterRecords(zoneRecords, domain.FQDN, "A"), currentIPv4, "A", domain)
+				case errors.Is(err, wanip.ErrCGNAT) && u.cfg.CGNAT == config.CGNATWithdrawValue:
+					withdrawRecords(ctx, zone.client, filterRecords(zoneRecords, domain.FQDN, "A"), domain)
+				}
+			}
+
+			switch domain.IPv6 {
+			case config.IPv6FritzBoxIPValue, config.IPv6HostIPValue, config.IPv6WANIPValue:
+				if currentIPv6, err := ips.get(ctx, domain.IPv6); err == nil {
+					tryUpdateRecordWithConstIP(ctx, zone.client, filterRecords(zoneRecords, domain.FQDN, "AAAA"), currentIPv6, "AAAA", domain)
+				}
+			case config.IPv6PrefixOnlyValue:
+				if currentIPv6Prefix, err := ips.get(ctx, domain.IPv6); err == nil {
+					tryUpdateRecordWithIPv6Prefix(ctx, zone.client, filterRecords(zoneRecords, domain.FQDN, "AAAA"), currentIPv6Prefix, domain)
+				}
+			}
+		}
+	}
+
+	if u.cfg.Sweep {
+		for i, zone := range zones {
+			u.sweep(ctx, zone, allZoneRecords[i], retrieved[i], ips)
 		}
-	} else if IPv6Value == IPv6PrefixOnlyValue {
-		// The user set IPV6=prefix-only explicitly
-		currentIPv6Prefix, IPv6Err = wanip.GetIPv6PrefixFromFritzBox()
-		if IPv6Err != nil {
+	}
+}
+
+// ipv4Source identifies the WAN IPv4. The IPv6 sources are identified by their config values, e.g. config.IPv6HostIPValue.
+const ipv4Source = "ipv4"
+
+// currentIPs caches the result of every IP source for one update cycle.
+type currentIPs struct {
+	fetch   func(ctx context.Context, source string) (string, error)
+	results map[string]ipResult
+}
+
+type ipResult struct {
+	ip  string
+	err error
+}
+
+func newCurrentIPs(fetch func(ctx context.Context, source string) (string, error)) *currentIPs {
+	return &currentIPs{fetch: fetch, results: map[string]ipResult{}}
+}
+
+// get returns the current IP of source. The source is only queried on the first call, later calls return the cached result.
+func (c *currentIPs) get(ctx context.Context, source string) (string, error) {
+	result, present := c.results[source]
+	if !present {
+		result.ip, result.err = c.fetch(ctx, source)
+		c.results[source] = result
+	}
+
+	return result.ip, result.err
+}
+
+// fetchIP queries source for the current IP. Failures are logged.
+func (u *Updater) fetchIP(ctx context.Context, source string) (string, error) {
+	if source == config.IPv6PrefixOnlyValue {
+		// The prefix is returned in CIDR notation to keep its length, e.g. "2001:db8:1234:5600::/56"
+		prefix, prefixLength, err := u.fritzBox.IPv6Prefix(ctx)
+		if err != nil {
 			logger.Warnf("Retrieving current IPv6 prefix via FRITZ!Box failed.")
+			return "", err
 		}
+
+		return fmt.Sprintf("%s/%d", prefix, prefixLength), nil
 	}
 
-	for _, fqdn := range domains {
-		if !isFQDNValid(fqdn) {
-			logger.Warnf("%s is not a valid domain.", fqdn)
-			return
+	chain, present := u.chains[source]
+	assert.Assert(present, "source should be a known IP source")
+
+	result, err := chain.IP(ctx)
+	if err != nil {
+		switch {
+		case errors.Is(err, wanip.ErrCGNAT):
+			logger.Warnf("The WAN IPv4 is a carrier-grade NAT address, so this connection has no public IPv4 (e.g. DS-Lite) and A-Records would be unreachable. A-Records are left unchanged. Set %s=%s to remove them and keep only AAAA-Records, or ask the provider for a public IPv4. %s",
+				config.CGNATEnvKey, config.CGNATWithdrawValue, err)
+		case source == ipv4Source:
+			logger.Warnf("Retrieving current WAN IPv4 failed, none of the sources in %s succeeded.", config.IPv4SourcesEnvKey)
+		case source == config.IPv6WANIPValue:
+			logger.Warnf("Retrieving current WAN IPv6 failed, none of the sources in %s succeeded.", config.IPv6SourcesEnvKey)
+		case source == config.IPv6FritzBoxIPValue:
+			logger.Warnf("Retrieving current WAN IPv6 of FRITZ!Box failed.")
+		case source == config.IPv6HostIPValue:
+			logger.Warnf("Retrieving current host IPv6 failed. Is the host running on a (Docker) network with IPv6 support?")
 		}
+		return "", err
+	}
+
+	return result.IP.String(), nil
+}
+
+// managedDomain is one configured domain together with its settings.
+type managedDomain struct {
+	config.Domain
+}
+
+// zone contains all managed domains sharing the same root domain and API key pair.
+type zone struct {
+	rootDomain string
+	client     *porkbun.Client
+	domains    []managedDomain
+}
+
+// groupByRootDomain groups domains by their root domain and API key pair. The order of first appearance is kept.
+func groupByRootDomain(domains []config.Domain, clients map[config.Credentials]*porkbun.Client) []zone {
+	type zoneKey struct {
+		rootDomain  string
+		credentials config.Credentials
+	}
+
+	var zones []zone
+	zoneIndices := map[zoneKey]int{}
 
-		subdomain, rootDomain := getSubAndRootDomain(fqdn)
+	for _, domain := range domains {
+		client, present := clients[domain.Credentials]
+		assert.Assert(present, "clients should contain a client for every API key pair of the configuration")
 
-		if (IPv4Value == "true" || !IPv4ValuePresent) && IPv4Err == nil {
-			assert.Assert(currentIPv4 != "", "currentIPv4 should be set here because it's checked in the beginning of this function")
-			tryUpdateRecordWithConstIP(currentIPv4, "A", fqdn, subdomain, rootDomain, apikey, secretkey)
+		key := zoneKey{rootDomain: domain.RootDomain, credentials: domain.Credentials}
+
+		index, present := zoneIndices[key]
+		if !present {
+			index = len(zones)
+			zoneIndices[key] = index
+			zones = append(zones, zone{rootDomain: domain.RootDomain, client: client})
 		}
 
-		if IPv6Value == IPv6FritzBoxIPValue && IPv6Err == nil {
-			assert.Assert(currentFritzboxIPv6 != "", "currentFritzboxIPv6 should be set here because it's checked in the beginning of this function")
-			tryUpdateRecordWithConstIP(currentFritzboxIPv6, "AAAA", fqdn, subdomain, rootDomain, apikey, secretkey)
-		} else if IPv6Value == IPv6HostIPValue && IPv6Err == nil {
-			assert.Assert(currentHostIPv6 != "", "currentHostIPv6 should be set here because it's checked in the beginning of this function")
-			tryUpdateRecordWithConstIP(currentHostIPv6, "AAAA", fqdn, subdomain, rootDomain, apikey, secretkey)
-		} else if IPv6Value == IPv6PrefixOnlyValue && IPv6Err == nil {
-			assert.Assert(currentIPv6Prefix != "", "currentIPv6Prefix should be set here because it's checked in the beginning of this function")
-			tryUpdateRecordWithIPv6Prefix(currentIPv6Prefix, fqdn, subdomain, rootDomain, apikey, secretkey)
+		zones[index].domains = append(zones[index].domains, managedDomain{Domain: domain})
+	}
+
+	return zones
+}
+
+// recordParams returns the desired state of a record of domain.
+func (domain managedDomain) recordParams(recordType string, content string) porkbun.RecordParams {
+	return porkbun.RecordParams{Name: domain.Subdomain, Type: recordType, Content: content, TTL: domain.TTL, Notes: domain.Notes}
+}
+
+// isUpToDate reports whether record points to wantedIP and, if the TTL and notes are managed, has the configured TTL and notes.
+func (domain managedDomain) isUpToDate(record porkbun.Record, wantedIP string) bool {
+	if record.Content != wantedIP {
+		return false
+	}
+
+	if domain.TTL != 0 && record.TTL != strconv.Itoa(domain.TTL) {
+		return false
+	}
+
+	return domain.Notes == "" || record.Notes == domain.Notes
+}
+
+// ownedRecords returns the records of activeRecords that may be edited or deleted.
+// With strict ownership only records tagged with the ownership marker are returned, foreign records are reported.
+func (domain managedDomain) ownedRecords(activeRecords []porkbun.Record) []porkbun.Record {
+	if !domain.StrictOwnership {
+		return activeRecords
+	}
+
+	var ownedRecords []porkbun.Record
+
+	for _, record := range activeRecords {
+		if record.Notes == domain.Notes {
+			ownedRecords = append(ownedRecords, record)
+			continue
 		}
+
+		logger.Warnf("Ignoring foreign %s-Record of %s pointing to %s because it's not tagged with the ownership marker %q.", record.Type, domain.FQDN, record.Content, domain.Notes)
 	}
+
+	return ownedRecords
 }
 
-func tryUpdateRecordWithConstIP(currentIP string, recordType string, fqdn string, subdomain string, rootDomain string, apikey string, secretkey string) {
-	retrievedRecords, err := retrieveRecords(subdomain, rootDomain, recordType, apikey, secretkey)
-	if err != nil {
-		logger.Warnf("Skipping %s-Record update of %s because retrieval of active records failed. %s", recordType, fqdn, err)
-		return
+// filterRecords returns all records of zoneRecords matching fqdn and recordType.
+func filterRecords(zoneRecords []porkbun.Record, fqdn string, recordType string) []porkbun.Record {
+	var records []porkbun.Record
+
+	for _, record := range zoneRecords {
+		if strings.EqualFold(record.Name, fqdn) && record.Type == recordType {
+			records = append(records, record)
+		}
 	}
 
-	switch len(retrievedRecords) {
+	return records
+}
+
+// tryUpdateRecordWithConstIP makes sure that exactly one record of recordType points to currentIP.
+// activeRecords are the records of recordType that currently exist for the domain.
+// With strict ownership no record is created beside foreign records, otherwise the FQDN would resolve to both IPs.
+func tryUpdateRecordWithConstIP(ctx context.Context, client *porkbun.Client, activeRecords []porkbun.Record, currentIP string, recordType string, domain managedDomain) {
+	ownedRecords := domain.ownedRecords(activeRecords)
+
+	switch len(ownedRecords) {
 	case 0:
-		createRecord(subdomain, rootDomain, recordType, currentIP, apikey, secretkey)
+		if len(activeRecords) > 0 {
+			logger.Warnf("Leaving %s alone because it only has foreign %s-Records. Tag one of them with the ownership marker %q in the Porkbun WebGUI or delete them to let GorkbunDDNS manage it.", domain.FQDN, recordType, domain.Notes)
+			return
+		}
+
+		createRecord(ctx, client, domain, recordType, currentIP)
 	case 1:
-		oldRecord := retrievedRecords[0]
-		if oldRecord.IP == currentIP {
-			log.Printf("%s-Record of %s is up to date.", recordType, fqdn)
+		oldRecord := ownedRecords[0]
+		if domain.isUpToDate(oldRecord, currentIP) {
+			log.Printf("%s-Record of %s is up to date.", recordType, domain.FQDN)
 			return
 		}
 
-		editRecord(subdomain, rootDomain, recordType, currentIP, apikey, secretkey, oldRecord.ID, oldRecord.IP)
+		editRecord(ctx, client, domain, oldRecord, currentIP)
 	default:
-		logger.Warnf("Multiple active %s-Records found for %s. Please clean up the DNS records in the Porkbun WebGUI or set the environment variable %s=%s to automatically unify them.",
-			recordType, fqdn, mulRecordsEnvKey, mulRecordsUnifyValue)
+		if domain.MultipleRecords != config.MulRecordsUnifyValue {
+			logger.Warnf("Multiple active %s-Records found for %s. Please clean up the DNS records in the Porkbun WebGUI or set the environment variable %s=%s (multipleRecords: %[4]s in the configuration file) to automatically unify them.",
+				recordType, domain.FQDN, config.MulRecordsEnvKey, config.MulRecordsUnifyValue)
+			return
+		}
+
+		keptRecord, obsoleteRecords := splitKeptRecord(ownedRecords, currentIP)
+		unifyRecords(ctx, client, keptRecord, obsoleteRecords, currentIP, recordType, domain)
 	}
 }
 
-func tryUpdateRecordWithIPv6Prefix(currentIPv6Prefix string, fqdn string, subdomain string, rootDomain string, apikey string, secretkey string) {
+// tryUpdateRecordWithIPv6Prefix replaces the prefix of the existing AAAA-Records with currentIPv6Prefix.
+// Multiple records are updated independently unless they should be unified.
+// currentIPv6Prefix is in CIDR notation, e.g. "2001:db8:1234:5600::/56".
+// If the domain has a fixed IPv6 suffix, the record is created if missing and its interface ID is corrected as well.
+// activeRecords are the AAAA-Records that currently exist for the domain.
+func tryUpdateRecordWithIPv6Prefix(ctx context.Context, client *porkbun.Client, activeRecords []porkbun.Record, currentIPv6Prefix string, domain managedDomain) {
 	recordType := "AAAA"
 
-	retrievedRecords, err := retrieveRecords(subdomain, rootDomain, recordType, apikey, secretkey)
-	if err != nil {
-		logger.Warnf("Skipping %s-Record update of %s because retrieval of active records failed.", recordType, fqdn)
+	if domain.IPv6Suffix != "" {
+		IPv6Addr, err := domain.ipv6Address(currentIPv6Prefix, domain.IPv6Suffix)
+		if err != nil {
+			logger.Warnf("Could not build the %s-Record of %s. %s", recordType, domain.FQDN, err)
+			return
+		}
+
+		tryUpdateRecordWithConstIP(ctx, client, activeRecords, IPv6Addr, recordType, domain)
 		return
 	}
 
-	switch len(retrievedRecords) {
+	activeRecords = domain.ownedRecords(activeRecords)
+
+	switch len(activeRecords) {
 	case 0:
-		logger.Warnf("No %s-Record found for %s. Can only edit existing %[1]s-Records with %[3]s=%s.", recordType, fqdn, IPv6EnvKey, IPv6PrefixOnlyValue)
+		logger.Warnf("No %s-Record found for %s. Can only edit existing %[1]s-Records with %[3]s=%s unless an IPv6 suffix is configured in %s.", recordType, domain.FQDN, config.IPv6EnvKey, config.IPv6PrefixOnlyValue, config.IPv6SuffixPerDomainEnvKey)
 	case 1:
-		oldRecord := retrievedRecords[0]
+		oldRecord := activeRecords[0]
 
-		IPv6Addr := combineIPv6PrefixAndInterfaceID(currentIPv6Prefix, oldRecord.IP)
+		IPv6Addr, err := domain.ipv6Address(currentIPv6Prefix, oldRecord.Content)
+		if err != nil {
+			logger.Warnf("Could not build the %s-Record of %s. %s", recordType, domain.FQDN, err)
+			return
+		}
 
-		if oldRecord.IP == IPv6Addr {
-			log.Printf("%s-Record of %s is up to date.", recordType, fqdn)
+		if domain.isUpToDate(oldRecord, IPv6Addr) {
+			log.Printf("%s-Record of %s is up to date.", recordType, domain.FQDN)
 			return
 		}
 
-		editRecord(subdomain, rootDomain, recordType, IPv6Addr, apikey, secretkey, oldRecord.ID, oldRecord.IP)
+		editRecord(ctx, client, domain, oldRecord, IPv6Addr)
 	default:
-		logger.Warnf("Multiple active %s-Records found for %s. Can only edit existing %[1]s-Records with %[3]s=%s.",
-			recordType, fqdn, IPv6EnvKey, IPv6PrefixOnlyValue)
+		if domain.MultipleRecords != config.MulRecordsUnifyValue {
+			// Multi-homed hosts and round-robin names: every record keeps its own interface ID
+			updateEachRecordWithIPv6Prefix(ctx, client, activeRecords, currentIPv6Prefix, domain)
+			return
+		}
+
+		// The interface ID of the first record is kept, all other records are removed
+		IPv6Addr, err := domain.ipv6Address(currentIPv6Prefix, activeRecords[0].Content)
+		if err != nil {
+			logger.Warnf("Could not build the %s-Record of %s. %s", recordType, domain.FQDN, err)
+			return
+		}
+
+		keptRecord, obsoleteRecords := splitKeptRecord(activeRecords, IPv6Addr)
+		unifyRecords(ctx, client, keptRecord, obsoleteRecords, IPv6Addr, recordType, domain)
 	}
 }
 
-// combineIPv6PrefixAndInterfaceID combines an the prefix of an IPv6 address and the interface ID of another IPv6 address to a combined IPv6 address.
-// The IPv6 addresses should be RFC 5952 ("2001:db8::1") compliant.
-// The returned IPv6 address is also RFC 5952 compliant.
-// Example: combineIPv6PrefixAndInterfaceID("2001:db8::", "fe80:efef:db8:1234:5678:90ab:cdef:0123") returns "2001:db8::5678:90ab:cdef:123".
-func combineIPv6PrefixAndInterfaceID(prefixIPv6 string, interfaceIDIPv6 string) string {
-	prefixAddr := net.ParseIP(prefixIPv6)
-	assert.Assert(prefixAddr != nil, "prefixIPv6 should be a valid IP address")
-	prefixAddr = prefixAddr.To16()
-	assert.Assert(prefixAddr != nil, "prefixIPv6 should be a valid IPv6 address")
+// updateEachRecordWithIPv6Prefix replaces the prefix of every record of activeRecords with currentIPv6Prefix, keeping its interface ID.
+// Records that point to the same address afterwards are duplicates, only one of them is kept.
+func updateEachRecordWithIPv6Prefix(ctx context.Context, client *porkbun.Client, activeRecords []porkbun.Record, currentIPv6Prefix string, domain managedDomain) {
+	var addresses []string
+	recordsByAddress := map[string][]porkbun.Record{}
 
-	prefix := fmt.Sprintf("%x:%x:%x:%x",
-		uint16(prefixAddr[0])<<8|uint16(prefixAddr[1]),
-		uint16(prefixAddr[2])<<8|uint16(prefixAddr[3]),
-		uint16(prefixAddr[4])<<8|uint16(prefixAddr[5]),
-		uint16(prefixAddr[6])<<8|uint16(prefixAddr[7]),
-	)
+	for _, record := range activeRecords {
+		IPv6Addr, err := domain.ipv6Address(currentIPv6Prefix, record.Content)
+		if err != nil {
+			logger.Warnf("Could not build the %s-Record of %s pointing to %s. %s", record.Type, domain.FQDN, record.Content, err)
+			continue
+		}
 
-	interfaceIDAddr := net.ParseIP(interfaceIDIPv6)
-	assert.Assert(interfaceIDAddr != nil, "interfaceIDIPv6 should be a valid IP address")
-	interfaceIDAddr = interfaceIDAddr.To16()
-	assert.Assert(interfaceIDAddr != nil, "interfaceIDIPv6 should be a valid IPv6 address")
+		if _, present := recordsByAddress[IPv6Addr]; !present {
+			addresses = append(addresses, IPv6Addr)
+		}
+		recordsByAddress[IPv6Addr] = append(recordsByAddress[IPv6Addr], record)
+	}
 
-	// Get the interface ID from the IPv6 address
-	// Example: 2001:db8:abcd:1234:5678:90ab:cdef:0123
-	interfaceID := fmt.Sprintf("%x:%x:%x:%x",
-		uint16(interfaceIDAddr[8])<<8|uint16(interfaceIDAddr[9]), // uint16(addr[8])<<8 = 0x5600, addr[9] = 0x78, => 0x5678
-		uint16(interfaceIDAddr[10])<<8|uint16(interfaceIDAddr[11]),
-		uint16(interfaceIDAddr[12])<<8|uint16(interfaceIDAddr[13]),
-		uint16(interfaceIDAddr[14])<<8|uint16(interfaceIDAddr[15]),
-	)
+	for _, IPv6Addr := range addresses {
+		keptRecord, duplicateRecords := splitKeptRecord(recordsByAddress[IPv6Addr], IPv6Addr)
 
-	netIP := net.ParseIP(fmt.Sprintf("%s:%s", prefix, interfaceID))
-	assert.Assert(netIP != nil, "combined IPv6 address should be a valid IP address")
+		if domain.isUpToDate(keptRecord, IPv6Addr) {
+			log.Printf("%s-Record of %s pointing to %s is up to date.", keptRecord.Type, domain.FQDN, IPv6Addr)
+		} else {
+			editRecord(ctx, client, domain, keptRecord, IPv6Addr)
+		}
 
-	return netIP.String()
+		for _, record := range duplicateRecords {
+			deleteRecord(ctx, client, domain, record)
+		}
+	}
 }
 
-// getSubAndRootDomain splits a fully qualified domain name into subdomain and root domain.
-// getSubAndRootDomain("sub.example.com") returns "sub" and "example.com".
-func getSubAndRootDomain(fqdn string) (subdomain string, rootDomain string) {
-	domainParts := strings.Split(fqdn, ".")
-	rootDomain = strings.Join(domainParts[len(domainParts)-2:], ".")
-	subdomain = strings.Join(domainParts[:len(domainParts)-2], ".")
-	return subdomain, rootDomain
+// withdrawRecords deletes all activeRecords of domain, e.g. the A-Records while the WAN IPv4 is a carrier-grade NAT address.
+// With strict ownership only records tagged with the ownership marker are deleted.
+func withdrawRecords(ctx context.Context, client *porkbun.Client, activeRecords []porkbun.Record, domain managedDomain) {
+	for _, record := range domain.ownedRecords(activeRecords) {
+		log.Printf("Withdrawing %s-Record of %s pointing to %s because the connection is behind carrier-grade NAT.", record.Type, domain.FQDN, record.Content)
+		deleteRecord(ctx, client, domain, record)
+	}
 }
 
-// isFQDNValid checks if fqdn is likely a valid fully qualified domain name.
-// FQDN is guaranteed to match ^.*[a-zA-Z0-9]\\.[a-zA-Z]{2,}$.
-func isFQDNValid(fqdn string) bool {
-	matched, err := regexp.MatchString("^.*[a-zA-Z0-9]\\.[a-zA-Z]{2,}$", fqdn)
-	assert.IsNil(err)
-
-	return matched
+// logRetrievalError explains why the records of rootDomain couldn't be retrieved and what the user can do about it.
+func logRetrievalError(err error, rootDomain string) {
+	switch {
+	case errors.Is(err, porkbun.ErrAPIAccessDisabled):
+		logger.Warnf("Skipping %s because API access is not enabled for it. Please enable it on Porkbun's domain management site. %s", rootDomain, err)
+	case errors.Is(err, porkbun.ErrInvalidCredentials):
+		logger.Warnf("Skipping %s because the Porkbun server rejected the API keys. %s", rootDomain, err)
+	default:
+		logger.Warnf("Skipping %s because retrieval of active records failed. %s", rootDomain, err)
+	}
 }
 
-type retrievedRecord struct {
-	ID string
-	IP string
-}
+// splitKeptRecord selects the record that should remain after unifying.
+// A record already pointing to wantedIP is preferred, otherwise the first record is kept.
+// All other records are returned as obsoleteRecords.
+func splitKeptRecord(records []porkbun.Record, wantedIP string) (keptRecord porkbun.Record, obsoleteRecords []porkbun.Record) {
+	assert.Assert(len(records) > 0, "records should contain at least one record")
 
-// retrieveRecords gets the active record IDs and their associated IPs for a given FQDN and record type.
-// There may be zero, one, or multiple active records, each with different answers.
-func retrieveRecords(subdomain string, rootDomain string, recordType string, apikey string, secretkey string) ([]retrievedRecord, error) {
-	type retrieveResponse struct {
-		Status  string `json:"status"`
-		Records []struct {
-			Id      string `json:"id"`
-			Name    string `json:"name"`
-			Type    string `json:"type"`
-			Content string `json:"content"`
-			Ttl     string `json:"ttl"`
-			Prio    string `json:"prio"`
-			Notes   string `json:"notes"`
-		} `json:"records"`
-	}
-
-	requestBody := shared.RequestCredentials{SecretAPIKey: secretkey, APIKey: apikey}
-	jsonBody, err := json.Marshal(requestBody)
-	assert.IsNil(err)
-
-	resp, err := http.Post(fmt.Sprintf("https://api.porkbun.com/api/json/v3/dns/retrieveByNameType/%s/%s/%s",
-		rootDomain, recordType, subdomain), "application/json", bytes.NewReader(jsonBody))
-	if err != nil {
-		return []retrievedRecord{}, fmt.Errorf("Could not retrieve currently active %s-Records for %s.%s. %w", recordType, subdomain, rootDomain, err)
+	keptIndex := 0
+	for i, record := range records {
+		if record.Content == wantedIP {
+			keptIndex = i
+			break
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		// May happen! For example: 503 Service Temporarily Unavailable
-		return []retrievedRecord{}, fmt.Errorf("Something unexpected happened while retrieving active %s-Records for %s.%s.", recordType, subdomain, rootDomain)
+	for i, record := range records {
+		if i != keptIndex {
+			obsoleteRecords = append(obsoleteRecords, record)
+		}
 	}
 
-	var response retrieveResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return []retrievedRecord{}, fmt.Errorf("Porkbun server returned invalid JSON format while retrieving active %s-Records for %s.%s. %w", recordType, subdomain, rootDomain, err)
+	return records[keptIndex], obsoleteRecords
+}
+
+// unifyRecords points keptRecord to newIP and deletes all obsoleteRecords.
+// Afterwards exactly one record of recordType should exist for the FQDN.
+// If keptRecord can't be updated, obsoleteRecords are left alone so that the FQDN doesn't end up without a correct record.
+func unifyRecords(ctx context.Context, client *porkbun.Client, keptRecord porkbun.Record, obsoleteRecords []porkbun.Record, newIP string, recordType string, domain managedDomain) {
+	log.Printf("Unifying %d active %s-Records of %s.", len(obsoleteRecords)+1, recordType, domain.FQDN)
+
+	if domain.isUpToDate(keptRecord, newIP) {
+		log.Printf("%s-Record of %s is up to date.", recordType, domain.FQDN)
+	} else if err := editRecord(ctx, client, domain, keptRecord, newIP); err != nil {
+		logger.Warnf("Not deleting the other %s-Records of %s because the kept record couldn't be updated.", recordType, domain.FQDN)
+		return
 	}
 
-	var records []retrievedRecord
-	for _, record := range response.Records {
-		records = append(records, retrievedRecord{ID: record.Id, IP: record.Content})
+	for _, record := range obsoleteRecords {
+		deleteRecord(ctx, client, domain, record)
 	}
+}
+
+// ipv6Address builds the AAAA-Record content of domain from currentIPv6Prefix (CIDR notation) and the interface ID of interfaceIDIPv6.
+// The subnet ID of interfaceIDIPv6 is kept unless the domain has a configured subnet ID.
+func (domain managedDomain) ipv6Address(currentIPv6Prefix string, interfaceIDIPv6 string) (string, error) {
+	prefixAddr, prefixNet, err := net.ParseCIDR(currentIPv6Prefix)
+	assert.IsNil(err, "currentIPv6Prefix should be in CIDR notation")
+	prefixLength, _ := prefixNet.Mask.Size()
+
+	IPv6Addr := combineIPv6PrefixAndInterfaceID(prefixAddr.String(), prefixLength, interfaceIDIPv6)
 
-	return records, nil
+	if domain.IPv6SubnetID == nil {
+		return IPv6Addr, nil
+	}
+
+	return setIPv6SubnetID(IPv6Addr, prefixLength, *domain.IPv6SubnetID)
 }
 
-// createRecord request the Porkbun server to create a specific record.
-//
-// Valid recordTypes are "A", "MX", "CNAME", "ALIAS", "TXT", "NS", "AAAA", "SRV", "TLSA", "CAA", "HTTPS", "SVCB"
-func createRecord(subdomain string, rootDomain string, recordType string, newIP string, apikey string, secretkey string) {
-	type createRequest struct {
-		shared.RequestCredentials
-		Name    string `json:"name"`
-		Type    string `json:"type"`
-		Content string `json:"content"`
+// combineIPv6PrefixAndInterfaceID combines the first prefixLength bits of an IPv6 address and the remaining bits of another IPv6 address to a combined IPv6 address.
+// With a prefix length below 64 the remaining bits include the subnet ID of interfaceIDIPv6.
+// The IPv6 addresses should be RFC 5952 ("2001:db8::1") compliant.
+// The returned IPv6 address is also RFC 5952 compliant.
+// Example: combineIPv6PrefixAndInterfaceID("2001:db8::", 64, "fe80:efef:db8:1234:5678:90ab:cdef:0123") returns "2001:db8::5678:90ab:cdef:123".
+func combineIPv6PrefixAndInterfaceID(prefixIPv6 string, prefixLength int, interfaceIDIPv6 string) string {
+	assert.Assert(prefixLength >= 0 && prefixLength <= 128, "prefixLength should be between 0 and 128")
+
+	prefixAddr := net.ParseIP(prefixIPv6)
+	assert.Assert(prefixAddr != nil, "prefixIPv6 should be a valid IP address")
+	prefixAddr = prefixAddr.To16()
+	assert.Assert(prefixAddr != nil, "prefixIPv6 should be a valid IPv6 address")
+
+	interfaceIDAddr := net.ParseIP(interfaceIDIPv6)
+	assert.Assert(interfaceIDAddr != nil, "interfaceIDIPv6 should be a valid IP address")
+	interfaceIDAddr = interfaceIDAddr.To16()
+	assert.Assert(interfaceIDAddr != nil, "interfaceIDIPv6 should be a valid IPv6 address")
+
+	combined := make(net.IP, net.IPv6len)
+	for i := range combined {
+		// Example for a /60 prefix: byte 7 takes the upper 4 bits from the prefix (mask 0xf0) and the lower 4 bits from the interface ID
+		prefixBits := min(max(prefixLength-i*8, 0), 8)
+		mask := byte(0xff) << (8 - prefixBits)
+
+		combined[i] = prefixAddr[i]&mask | interfaceIDAddr[i]&^mask
 	}
 
-	requestBody := createRequest{RequestCredentials: shared.RequestCredentials{SecretAPIKey: secretkey, APIKey: apikey}, Name: subdomain, Type: recordType, Content: newIP}
-	jsonBody, err := json.Marshal(requestBody)
-	assert.IsNil(err)
+	return combined.String()
+}
 
-	resp, err := http.Post(fmt.Sprintf("https://api.porkbun.com/api/json/v3/dns/create/%s", rootDomain), "application/json", bytes.NewReader(jsonBody))
-	if err != nil {
-		logger.Warnf("Could not create %s-Record for %s.%s.", recordType, subdomain, rootDomain)
-		return
+// setIPv6SubnetID replaces the subnet ID of IPv6Addr, i.e. the bits between prefixLength and 64, with subnetID.
+// Returns an error if subnetID doesn't fit in these bits.
+func setIPv6SubnetID(IPv6Addr string, prefixLength int, subnetID uint64) (string, error) {
+	addr := net.ParseIP(IPv6Addr)
+	assert.Assert(addr != nil && addr.To4() == nil, "IPv6Addr should be a valid IPv6 address")
+	addr = addr.To16()
+
+	subnetBits := max(64-prefixLength, 0)
+	if subnetBits < 64 && subnetID >= 1<<subnetBits {
+		return "", fmt.Errorf("Subnet ID %x doesn't fit into the delegated /%d prefix, which has %d bits for subnets.", subnetID, prefixLength, subnetBits)
 	}
-	resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		logger.Warnf("Could not create %s-Record for %s.%s.", recordType, subdomain, rootDomain)
+	subnetMask := uint64(1)<<subnetBits - 1
+
+	networkPart := binary.BigEndian.Uint64(addr[:8])
+	binary.BigEndian.PutUint64(addr[:8], networkPart&^subnetMask|subnetID)
+
+	return addr.String(), nil
+}
+
+// createRecord requests the Porkbun server to create a specific record.
+func createRecord(ctx context.Context, client *porkbun.Client, domain managedDomain, recordType string, newIP string) {
+	_, err := client.Create(ctx, domain.RootDomain, domain.recordParams(recordType, newIP))
+	if err != nil {
+		logger.Warnf("Could not create %s-Record for %s. %s", recordType, domain.FQDN, err)
 		return
 	}
 
-	log.Printf("%s-Record for %s.%s created. New IP: %s.", recordType, subdomain, rootDomain, newIP)
+	log.Printf("%s-Record for %s created. New IP: %s.", recordType, domain.FQDN, newIP)
 }
 
-// editRecord updates the record matching id.
-// The subdomain, ?rootDomain? and IP will be changed accordingly.
+// editRecord updates oldRecord to point to newIP. The TTL is corrected as well if it's managed.
 // After execution and if the Porkbun server accepted the request, one record will point the IP. Note: this does not mean, that the edit was successful, neither that the record matching id will point to the IP.
-func editRecord(subdomain string, rootDomain string, recordType string, newIP string, apikey string, secretkey string, id string, oldIP string) {
-	type editRequest struct {
-		shared.RequestCredentials
-		Name    string `json:"name"`
-		Type    string `json:"type"`
-		Content string `json:"content"`
+// Returns the error of the request, which is already logged.
+func editRecord(ctx context.Context, client *porkbun.Client, domain managedDomain, oldRecord porkbun.Record, newIP string) error {
+	err := client.Edit(ctx, domain.RootDomain, oldRecord.ID, domain.recordParams(oldRecord.Type, newIP))
+	if err != nil {
+		logger.Warnf("Could not update %s-Record of %s. %s", oldRecord.Type, domain.FQDN, err)
+		return err
 	}
 
-	requestBody := editRequest{RequestCredentials: shared.RequestCredentials{SecretAPIKey: secretkey, APIKey: apikey}, Name: subdomain, Type: recordType, Content: newIP}
-	jsonBody, err := json.Marshal(requestBody)
-	assert.IsNil(err)
+	changes := []string{fmt.Sprintf("%s -> %s", oldRecord.Content, newIP)}
+	if oldRecord.Content == newIP {
+		changes = nil
+	}
+	if domain.TTL != 0 && oldRecord.TTL != strconv.Itoa(domain.TTL) {
+		changes = append(changes, fmt.Sprintf("TTL %s -> %d", oldRecord.TTL, domain.TTL))
+	}
+	if domain.Notes != "" && oldRecord.Notes != domain.Notes {
+		changes = append(changes, fmt.Sprintf("notes %q -> %q", oldRecord.Notes, domain.Notes))
+	}
 
-	var resp *http.Response
-	totalTries := 3
+	log.Printf("%s-Record of %s updated: %s.", oldRecord.Type, domain.FQDN, strings.Join(changes, ", "))
 
-	for i := 1; i <= totalTries; i++ {
-		resp, err = http.Post(fmt.Sprintf("https://api.porkbun.com/api/json/v3/dns/edit/%s/%s", rootDomain, id), "application/json", bytes.NewReader(jsonBody))
-		if err != nil {
-			logger.Warnf("Edit attempt %d/%d failed: %v", i, totalTries, err)
-		} else {
-			resp.Body.Close()
-			break
-		}
-	}
+	return nil
+}
 
+// deleteRecord requests the Porkbun server to delete record.
+func deleteRecord(ctx context.Context, client *porkbun.Client, domain managedDomain, record porkbun.Record) {
+	err := client.Delete(ctx, domain.RootDomain, record.ID)
 	if err != nil {
-		logger.Warnf("All attempts failed.")
-		return
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		logger.Warnf("Could not update %s-Record of %s.%s.", recordType, subdomain, rootDomain)
+		logger.Warnf("Could not delete %s-Record of %s pointing to %s. %s", record.Type, domain.FQDN, record.Content, err)
 		return
 	}
 
-	log.Printf("%s-Record of %s.%s updated: %s -> %s.", recordType, subdomain, rootDomain, oldIP, newIP)
+	log.Printf("%s-Record of %s pointing to %s deleted.", record.Type, domain.FQDN, record.Content)
 }
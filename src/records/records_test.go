@@ -1,24 +1,39 @@
 package records
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
 	"testing"
+
+	"bjoernblessin.de/gorkbunddns/src/config"
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
+	"bjoernblessin.de/gorkbunddns/src/wanip"
 )
 
 func TestCombineIPv6PrefixAndInterfaceID(t *testing.T) {
 	tests := []struct {
-		prefix   string
-		ipv6     string
-		expected string
+		prefix       string
+		prefixLength int
+		ipv6         string
+		expected     string
 	}{
-		{"2001:db8::", "::1234:5678:90ab:cdef:0123", "2001:db8::5678:90ab:cdef:123"},
-		{"2001:db8::", "fe80:efef:db8:1234:5678:90ab:cdef:0123", "2001:db8::5678:90ab:cdef:123"},
-		{"2001:efef:db8:1234::101", "fe80:efef:db8:1234:5678:90ab:cdef:0123", "2001:efef:db8:1234:5678:90ab:cdef:123"},
+		{"2001:db8::", 64, "::1234:5678:90ab:cdef:0123", "2001:db8::5678:90ab:cdef:123"},
+		{"2001:db8::", 64, "fe80:efef:db8:1234:5678:90ab:cdef:0123", "2001:db8::5678:90ab:cdef:123"},
+		{"2001:efef:db8:1234::101", 64, "fe80:efef:db8:1234:5678:90ab:cdef:0123", "2001:efef:db8:1234:5678:90ab:cdef:123"},
+		// The subnet ID (bits between the prefix length and 64) is taken from the second address
+		{"2001:db8:1234::", 48, "2001:db8:9999:1a:211:32ff:fe12:3456", "2001:db8:1234:1a:211:32ff:fe12:3456"},
+		{"2001:db8:1234:5600::", 56, "2001:db8:9999:991a:211:32ff:fe12:3456", "2001:db8:1234:561a:211:32ff:fe12:3456"},
+		{"2001:db8:1234:5670::", 60, "2001:db8:9999:999a:211:32ff:fe12:3456", "2001:db8:1234:567a:211:32ff:fe12:3456"},
+		{"2001:db8:1234:5678::", 64, "2001:db8:9999:9999:211:32ff:fe12:3456", "2001:db8:1234:5678:211:32ff:fe12:3456"},
 	}
 
 	for index, testcase := range tests {
 		t.Run(fmt.Sprintf("TestCase%d", index+1), func(t *testing.T) {
-			result := combineIPv6PrefixAndInterfaceID(testcase.prefix, testcase.ipv6)
+			result := combineIPv6PrefixAndInterfaceID(testcase.prefix, testcase.prefixLength, testcase.ipv6)
 			if result != testcase.expected {
 				t.Errorf("expected: %s, got: %s", testcase.expected, result)
 			}
@@ -27,50 +42,342 @@ func TestCombineIPv6PrefixAndInterfaceID(t *testing.T) {
 	}
 }
 
-func TestGetSubAndRootDomain(t *testing.T) {
+func TestIPv6Address(t *testing.T) {
+	subnetID := func(id uint64) *uint64 { return &id }
+
 	tests := []struct {
-		fqdn         string
-		expectedSub  string
-		expectedRoot string
+		name          string
+		prefix        string
+		subnetID      *uint64
+		interfaceID   string
+		expected      string
+		expectedError bool
 	}{
-		{"sub.example.com", "sub", "example.com"},
-		{"example.com", "", "example.com"},
-		{"sub.sub.example.com", "sub.sub", "example.com"},
-		{"*.example.com", "*", "example.com"},
+		{"/48KeepsSubnetID", "2001:db8:1234::/48", nil, "2001:db8:9999:1a:211:32ff:fe12:3456", "2001:db8:1234:1a:211:32ff:fe12:3456", false},
+		{"/48SubnetID", "2001:db8:1234::/48", subnetID(0xbeef), "2001:db8:9999:1a:211:32ff:fe12:3456", "2001:db8:1234:beef:211:32ff:fe12:3456", false},
+		{"/56SubnetID", "2001:db8:1234:5600::/56", subnetID(0x2), "::211:32ff:fe12:3456", "2001:db8:1234:5602:211:32ff:fe12:3456", false},
+		{"/56SubnetIDTooLarge", "2001:db8:1234:5600::/56", subnetID(0x100), "::211:32ff:fe12:3456", "", true},
+		{"/60SubnetID", "2001:db8:1234:5670::/60", subnetID(0xf), "2001:db8:9999:999a:211:32ff:fe12:3456", "2001:db8:1234:567f:211:32ff:fe12:3456", false},
+		{"/60SubnetIDTooLarge", "2001:db8:1234:5670::/60", subnetID(0x10), "::1", "", true},
+		{"/64SubnetIDZero", "2001:db8:1234:5678::/64", subnetID(0), "::1", "2001:db8:1234:5678::1", false},
+		{"/64SubnetIDTooLarge", "2001:db8:1234:5678::/64", subnetID(1), "::1", "", true},
 	}
 
 	for _, testcase := range tests {
-		t.Run(testcase.fqdn, func(t *testing.T) {
-			sub, root := getSubAndRootDomain(testcase.fqdn)
-			if sub != testcase.expectedSub || root != testcase.expectedRoot {
-				t.Errorf("sub: %s, root: %s", sub, root)
+		t.Run(testcase.name, func(t *testing.T) {
+			domain := managedDomain{config.Domain{IPv6SubnetID: testcase.subnetID}}
+
+			result, err := domain.ipv6Address(testcase.prefix, testcase.interfaceID)
+			if (err != nil) != testcase.expectedError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != testcase.expected {
+				t.Errorf("expected: %s, got: %s", testcase.expected, result)
 			}
-			// assert.Assert(testcase.expectedSub == sub, t)
-			// assert.Assert(testcase.expectedRoot == root, t)
 		})
 	}
 }
 
-func TestIsFQDNValid(t *testing.T) {
+func TestSplitKeptRecord(t *testing.T) {
 	tests := []struct {
-		fqdn     string
-		expected bool
+		name             string
+		records          []porkbun.Record
+		wantedIP         string
+		expectedKeptID   string
+		expectedObsolete int
 	}{
-		{"example.de", true},
-		{"sub.example.com", true},
-		{"*.example.com", true},
-		{"example", false},
-		{"example.c", false},
-		{"example..com", false},
+		{"NoMatchKeepsFirst", []porkbun.Record{{ID: "1", Content: "1.1.1.1"}, {ID: "2", Content: "2.2.2.2"}}, "3.3.3.3", "1", 1},
+		{"MatchIsPreferred", []porkbun.Record{{ID: "1", Content: "1.1.1.1"}, {ID: "2", Content: "2.2.2.2"}, {ID: "3", Content: "3.3.3.3"}}, "3.3.3.3", "3", 2},
+		{"SingleRecord", []porkbun.Record{{ID: "1", Content: "1.1.1.1"}}, "1.1.1.1", "1", 0},
 	}
 
 	for _, testcase := range tests {
-		t.Run(testcase.fqdn, func(t *testing.T) {
-			result := isFQDNValid(testcase.fqdn)
-			if result != testcase.expected {
-				t.Errorf("expected: %t, got: %t", testcase.expected, result)
+		t.Run(testcase.name, func(t *testing.T) {
+			kept, obsolete := splitKeptRecord(testcase.records, testcase.wantedIP)
+			if kept.ID != testcase.expectedKeptID || len(obsolete) != testcase.expectedObsolete {
+				t.Errorf("kept: %s, obsolete: %d", kept.ID, len(obsolete))
+			}
+			for _, record := range obsolete {
+				if record.ID == kept.ID {
+					t.Errorf("kept record %s is also marked obsolete", kept.ID)
+				}
+			}
+		})
+	}
+}
+
+// fakePorkbunServer accepts every request and counts write requests by path.
+func fakePorkbunServer(t *testing.T, writes map[string]int) *porkbun.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writes[r.URL.Path]++
+		w.Write([]byte(`{"status":"SUCCESS"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return porkbun.NewClient(server.URL, server.Client(), "pk1_test", "sk1_test")
+}
+
+func TestTryUpdateRecordWithConstIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		records        []porkbun.Record
+		unify          bool
+		ttl            int
+		expectedWrites map[string]int
+	}{
+		{"Create", nil, false, 0, map[string]int{"/dns/create/example.com": 1}},
+		{"UpToDate", []porkbun.Record{{ID: "1", Type: "A", Content: "203.0.113.1", TTL: "600"}}, false, 0, map[string]int{}},
+		{"Edit", []porkbun.Record{{ID: "1", Type: "A", Content: "203.0.113.2", TTL: "600"}}, false, 0, map[string]int{"/dns/edit/example.com/1": 1}},
+		{"MultipleSkip", []porkbun.Record{{ID: "1", Type: "A", Content: "203.0.113.2", TTL: "600"}, {ID: "2", Type: "A", Content: "203.0.113.3", TTL: "600"}}, false, 0, map[string]int{}},
+		{"TTLChanged", []porkbun.Record{{ID: "1", Type: "A", Content: "203.0.113.1", TTL: "600"}}, false, 3600, map[string]int{"/dns/edit/example.com/1": 1}},
+		{"MultipleUnify", []porkbun.Record{{ID: "1", Type: "A", Content: "203.0.113.2", TTL: "600"}, {ID: "2", Type: "A", Content: "203.0.113.1", TTL: "600"}}, true, 0, map[string]int{"/dns/delete/example.com/1": 1}},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			writes := map[string]int{}
+			client := fakePorkbunServer(t, writes)
+
+			domain := managedDomain{config.Domain{FQDN: "sub.example.com", Subdomain: "sub", RootDomain: "example.com", TTL: testcase.ttl}}
+			if testcase.unify {
+				domain.MultipleRecords = config.MulRecordsUnifyValue
+			}
+
+			tryUpdateRecordWithConstIP(context.Background(), client, testcase.records, "203.0.113.1", "A", domain)
+
+			if !maps.Equal(writes, testcase.expectedWrites) {
+				t.Errorf("expected writes: %v, got: %v", testcase.expectedWrites, writes)
+			}
+		})
+	}
+}
+
+func TestTryUpdateRecordWithConstIPStrictOwnership(t *testing.T) {
+	tests := []struct {
+		name           string
+		records        []porkbun.Record
+		expectedWrites map[string]int
+	}{
+		{"Create", nil, map[string]int{"/dns/create/example.com": 1}},
+		// Creating a record would make the FQDN resolve to the foreign IP and ours
+		{"OnlyForeign", []porkbun.Record{{ID: "1", Type: "A", Content: "203.0.113.2"}}, map[string]int{}},
+		{"EditOwned", []porkbun.Record{{ID: "1", Type: "A", Content: "203.0.113.2"}, {ID: "2", Type: "A", Content: "203.0.113.3", Notes: "gorkbun"}}, map[string]int{"/dns/edit/example.com/2": 1}},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			writes := map[string]int{}
+			client := fakePorkbunServer(t, writes)
+
+			domain := managedDomain{config.Domain{FQDN: "sub.example.com", Subdomain: "sub", RootDomain: "example.com", Notes: "gorkbun", StrictOwnership: true}}
+			tryUpdateRecordWithConstIP(context.Background(), client, testcase.records, "203.0.113.1", "A", domain)
+
+			if !maps.Equal(writes, testcase.expectedWrites) {
+				t.Errorf("expected writes: %v, got: %v", testcase.expectedWrites, writes)
+			}
+		})
+	}
+}
+
+func TestUnifyRecordsEditFailed(t *testing.T) {
+	writes := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writes[r.URL.Path]++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"ERROR","message":"Edit error: We were unable to edit the DNS record."}`))
+	}))
+	defer server.Close()
+	client := porkbun.NewClient(server.URL, server.Client(), "pk1_test", "sk1_test")
+
+	domain := managedDomain{config.Domain{FQDN: "sub.example.com", Subdomain: "sub", RootDomain: "example.com", MultipleRecords: config.MulRecordsUnifyValue}}
+	records := []porkbun.Record{{ID: "1", Type: "A", Content: "203.0.113.2"}, {ID: "2", Type: "A", Content: "203.0.113.3"}}
+
+	tryUpdateRecordWithConstIP(context.Background(), client, records, "203.0.113.1", "A", domain)
+
+	// The obsolete record is kept because the kept record still points to the old IP
+	expected := map[string]int{"/dns/edit/example.com/1": 1}
+	if !maps.Equal(writes, expected) {
+		t.Errorf("expected writes: %v, got: %v", expected, writes)
+	}
+}
+
+func TestTryUpdateRecordWithIPv6Prefix(t *testing.T) {
+	tests := []struct {
+		name           string
+		records        []porkbun.Record
+		suffix         string
+		expectedWrites map[string]int
+	}{
+		{"NoRecordWithoutSuffix", nil, "", map[string]int{}},
+		{"PrefixChanged", []porkbun.Record{{ID: "1", Type: "AAAA", Content: "2001:db8:1::211:32ff:fe12:3456"}}, "", map[string]int{"/dns/edit/example.com/1": 1}},
+		{"UpToDate", []porkbun.Record{{ID: "1", Type: "AAAA", Content: "2001:db8:2::1"}}, "", map[string]int{}},
+		{"MultipleKeepInterfaceIDs", []porkbun.Record{{ID: "1", Type: "AAAA", Content: "2001:db8:1::1"}, {ID: "2", Type: "AAAA", Content: "2001:db8:1::2"}, {ID: "3", Type: "AAAA", Content: "2001:db8:2::3"}}, "", map[string]int{"/dns/edit/example.com/1": 1, "/dns/edit/example.com/2": 1}},
+		{"MultipleDuplicatesAfterRewrite", []porkbun.Record{{ID: "1", Type: "AAAA", Content: "2001:db8:1::1"}, {ID: "2", Type: "AAAA", Content: "2001:db8:2::1"}, {ID: "3", Type: "AAAA", Content: "2001:db8:3::1"}}, "", map[string]int{"/dns/delete/example.com/1": 1, "/dns/delete/example.com/3": 1}},
+		{"CreateWithSuffix", nil, "::211:32ff:fe12:3456", map[string]int{"/dns/create/example.com": 1}},
+		{"SuffixDrifted", []porkbun.Record{{ID: "1", Type: "AAAA", Content: "2001:db8:2::1"}}, "::211:32ff:fe12:3456", map[string]int{"/dns/edit/example.com/1": 1}},
+		{"UpToDateWithSuffix", []porkbun.Record{{ID: "1", Type: "AAAA", Content: "2001:db8:2:0:211:32ff:fe12:3456"}}, "::211:32ff:fe12:3456", map[string]int{}},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			writes := map[string]int{}
+			client := fakePorkbunServer(t, writes)
+
+			domain := managedDomain{config.Domain{FQDN: "nas.example.com", Subdomain: "nas", RootDomain: "example.com", IPv6Suffix: testcase.suffix}}
+			tryUpdateRecordWithIPv6Prefix(context.Background(), client, testcase.records, "2001:db8:2::/64", domain)
+
+			if !maps.Equal(writes, testcase.expectedWrites) {
+				t.Errorf("expected writes: %v, got: %v", testcase.expectedWrites, writes)
+			}
+		})
+	}
+}
+
+func TestGroupByRootDomain(t *testing.T) {
+	account1 := config.Credentials{APIKey: "pk1_one", SecretKey: "sk1_one"}
+	account2 := config.Credentials{APIKey: "pk1_two", SecretKey: "sk1_two"}
+	clients := map[config.Credentials]*porkbun.Client{
+		account1: porkbun.NewClient("", nil, account1.APIKey, account1.SecretKey),
+		account2: porkbun.NewClient("", nil, account2.APIKey, account2.SecretKey),
+	}
+
+	domains := []config.Domain{
+		{FQDN: "a.example.com", RootDomain: "example.com", Credentials: account1},
+		{FQDN: "example.org", RootDomain: "example.org", Credentials: account1},
+		{FQDN: "b.example.com", RootDomain: "example.com", Credentials: account1},
+		{FQDN: "example.com", RootDomain: "example.com", Credentials: account1},
+		{FQDN: "c.example.com", RootDomain: "example.com", Credentials: account2},
+	}
+	zones := groupByRootDomain(domains, clients)
+
+	if len(zones) != 3 || zones[0].rootDomain != "example.com" || zones[1].rootDomain != "example.org" || zones[2].rootDomain != "example.com" {
+		t.Fatalf("unexpected zones: %v", zones)
+	}
+	if len(zones[0].domains) != 3 || zones[0].domains[1].FQDN != "b.example.com" {
+		t.Errorf("unexpected domains of example.com: %v", zones[0].domains)
+	}
+	if zones[0].client != clients[account1] || zones[2].client != clients[account2] {
+		t.Errorf("zones use the wrong clients")
+	}
+}
+
+func TestFilterRecords(t *testing.T) {
+	zoneRecords := []porkbun.Record{
+		{ID: "1", Name: "example.com", Type: "A"},
+		{ID: "2", Name: "sub.example.com", Type: "A"},
+		{ID: "3", Name: "sub.example.com", Type: "AAAA"},
+		{ID: "4", Name: "Sub.Example.com", Type: "A"},
+		{ID: "5", Name: "sub.sub.example.com", Type: "A"},
+	}
+
+	records := filterRecords(zoneRecords, "sub.example.com", "A")
+	if len(records) != 2 || records[0].ID != "2" || records[1].ID != "4" {
+		t.Errorf("unexpected records: %v", records)
+	}
+}
+
+func TestOwnedRecords(t *testing.T) {
+	records := []porkbun.Record{
+		{ID: "1", Type: "A", Content: "203.0.113.1", Notes: "gorkbun"},
+		{ID: "2", Type: "A", Content: "203.0.113.2", Notes: ""},
+		{ID: "3", Type: "A", Content: "203.0.113.3", Notes: "other instance"},
+	}
+
+	tests := []struct {
+		name        string
+		domain      managedDomain
+		expectedIDs []string
+	}{
+		{"NotStrict", managedDomain{config.Domain{FQDN: "example.com", Notes: "gorkbun"}}, []string{"1", "2", "3"}},
+		{"Strict", managedDomain{config.Domain{FQDN: "example.com", Notes: "gorkbun", StrictOwnership: true}}, []string{"1"}},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			var ids []string
+			for _, record := range testcase.domain.ownedRecords(records) {
+				ids = append(ids, record.ID)
+			}
+
+			if !slices.Equal(ids, testcase.expectedIDs) {
+				t.Errorf("expected: %v, got: %v", testcase.expectedIDs, ids)
+			}
+		})
+	}
+}
+
+func TestCurrentIPsFetchesOnce(t *testing.T) {
+	fetches := map[string]int{}
+	ips := newCurrentIPs(func(ctx context.Context, source string) (string, error) {
+		fetches[source]++
+		if source == config.IPv6HostIPValue {
+			return "", fmt.Errorf("no global unicast IPv6")
+		}
+		return "203.0.113.1", nil
+	})
+
+	for range 3 {
+		ips.get(context.Background(), ipv4Source)
+		ips.get(context.Background(), config.IPv6HostIPValue)
+	}
+
+	expected := map[string]int{ipv4Source: 1, config.IPv6HostIPValue: 1}
+	if !maps.Equal(fetches, expected) {
+		t.Errorf("expected fetches: %v, got: %v", expected, fetches)
+	}
+
+	if _, err := ips.get(context.Background(), config.IPv6HostIPValue); err == nil {
+		t.Errorf("expected the cached error")
+	}
+}
+
+func TestUpdaterCGNAT(t *testing.T) {
+	tests := []struct {
+		name           string
+		cgnat          string
+		expectedWrites map[string]int
+	}{
+		{"Keep", config.CGNATKeepValue, map[string]int{}},
+		{"Withdraw", config.CGNATWithdrawValue, map[string]int{"/dns/delete/example.com/1": 1}},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			writes := map[string]int{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/dns/retrieve/example.com" {
+					w.Write([]byte(`{"status":"SUCCESS","records":[
+						{"id":"1","name":"example.com","type":"A","content":"203.0.113.1","ttl":"600"},
+						{"id":"2","name":"example.com","type":"AAAA","content":"2001:db8::1","ttl":"600"}
+					]}`))
+					return
+				}
+
+				writes[r.URL.Path]++
+				w.Write([]byte(`{"status":"SUCCESS"}`))
+			}))
+			defer server.Close()
+
+			credentials := config.Credentials{APIKey: "pk1_test", SecretKey: "sk1_test"}
+			cfg := &config.Config{
+				CGNAT:   testcase.cgnat,
+				Domains: []config.Domain{{FQDN: "example.com", RootDomain: "example.com", Credentials: credentials, IPv4: true, IPv6: config.IPv6WANIPValue}},
+			}
+			clients := map[config.Credentials]*porkbun.Client{credentials: porkbun.NewClient(server.URL, server.Client(), credentials.APIKey, credentials.SecretKey)}
+
+			updater := NewUpdater(cfg, clients)
+			updater.fetch = func(ctx context.Context, source string) (string, error) {
+				if source == ipv4Source {
+					return "", fmt.Errorf("fritzbox: 100.64.0.1 is in the carrier-grade NAT range. %w", wanip.ErrCGNAT)
+				}
+				return "2001:db8::1", nil
+			}
+
+			updater.Update(context.Background())
+
+			if !maps.Equal(writes, testcase.expectedWrites) {
+				t.Errorf("expected writes: %v, got: %v", testcase.expectedWrites, writes)
 			}
-			// assert.Assert(testcase.expected == result, t)
 		})
 	}
 }
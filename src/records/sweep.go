@@ -0,0 +1,202 @@
+package records
+
+import (
+	"context"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"bjoernblessin.de/gorkbunddns/src/config"
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
+	"bjoernblessin.de/gorkbunddns/src/util/logger"
+)
+
+// ipChange is a changed IP of an IP source between two updates.
+type ipChange struct {
+	source string
+	oldIP  string
+	newIP  string
+}
+
+// changesSince returns the IP sources whose IP differs from previousIPs, e.g. the IPs a zone was last swept for. Sources without a previous or current IP are ignored.
+func (c *currentIPs) changesSince(previousIPs map[string]string) []ipChange {
+	var changes []ipChange
+
+	for source, result := range c.results {
+		previousIP, present := previousIPs[source]
+		if !present || result.err != nil || previousIP == result.ip {
+			continue
+		}
+
+		changes = append(changes, ipChange{source: source, oldIP: previousIP, newIP: result.ip})
+	}
+
+	// Map iteration order is random, the log output shouldn't be
+	slices.SortFunc(changes, func(a, b ipChange) int { return strings.Compare(a.source, b.source) })
+
+	return changes
+}
+
+// recordType returns the type of the records affected by c.
+func (c ipChange) recordType() string {
+	if c.source == ipv4Source {
+		return "A"
+	}
+
+	return "AAAA"
+}
+
+// rewrite returns the new content of a record whose content still points to the old IP.
+// A-Records must match the old IPv4 exactly. AAAA-Records must be in the old prefix (the old /64 for full IPv6 addresses) and keep their interface ID.
+// Returns false if content isn't affected by c.
+func (c ipChange) rewrite(content string) (string, bool) {
+	if c.source == ipv4Source {
+		return c.newIP, content == c.oldIP
+	}
+
+	oldPrefix, newPrefix := c.oldIP, c.newIP
+	if c.source != config.IPv6PrefixOnlyValue {
+		oldPrefix, newPrefix = oldPrefix+"/64", newPrefix+"/64"
+	}
+
+	_, oldNet, err := net.ParseCIDR(oldPrefix)
+	if err != nil {
+		return "", false
+	}
+
+	ip := net.ParseIP(content)
+	if ip == nil || ip.To4() != nil || !oldNet.Contains(ip) {
+		return "", false
+	}
+
+	newPrefixAddr, newNet, err := net.ParseCIDR(newPrefix)
+	if err != nil {
+		return "", false
+	}
+	prefixLength, _ := newNet.Mask.Size()
+
+	newContent := combineIPv6PrefixAndInterfaceID(newPrefixAddr.String(), prefixLength, content)
+
+	return newContent, newContent != ip.String()
+}
+
+// zoneID identifies a zone across updates.
+type zoneID struct {
+	rootDomain string
+	client     *porkbun.Client
+}
+
+// sweep rewrites the records of zone that still point to an IP of ips the zone was last swept for.
+// The IPs of ips are only remembered as swept once the sweep succeeded, so that failed sweeps are repeated by the next update.
+// zoneRecords are the records of zone, retrieved reports whether their retrieval succeeded.
+func (u *Updater) sweep(ctx context.Context, zone zone, zoneRecords []porkbun.Record, retrieved bool, ips *currentIPs) {
+	id := zoneID{rootDomain: zone.rootDomain, client: zone.client}
+
+	sweptIPs, present := u.sweptIPs[id]
+	if !present {
+		sweptIPs = map[string]string{}
+		u.sweptIPs[id] = sweptIPs
+	}
+
+	swept := retrieved
+
+	if changes := ips.changesSince(sweptIPs); retrieved && len(changes) > 0 {
+		for _, change := range changes {
+			log.Printf("Sweep: %s changed from %s to %s, checking all records of %s.", change.source, change.oldIP, change.newIP, zone.rootDomain)
+		}
+
+		swept = sweepZone(ctx, zone, zoneRecords, changes)
+	}
+
+	for source, result := range ips.results {
+		// The first IP of a source is remembered even if the zone couldn't be retrieved, there is nothing to sweep yet
+		if _, known := sweptIPs[source]; result.err == nil && (swept || !known) {
+			sweptIPs[source] = result.ip
+		}
+	}
+}
+
+// sweepZone rewrites all A- and AAAA-Records of zoneRecords that still point to an old IP of changes.
+// Records the regular update keeps up to date are skipped, i.e. A-Records of domains with IPv4 and AAAA-Records of domains with IPv6 enabled.
+// If a managed domain of zone uses strict ownership, only records tagged with an ownership marker of such a domain are rewritten.
+// Returns false if a record couldn't be rewritten.
+func sweepZone(ctx context.Context, zone zone, zoneRecords []porkbun.Record, changes []ipChange) bool {
+	var markers []string
+	for _, domain := range zone.domains {
+		if domain.StrictOwnership {
+			markers = append(markers, domain.Notes)
+		}
+	}
+
+	success := true
+
+	for _, record := range zoneRecords {
+		isManaged := slices.ContainsFunc(zone.domains, func(domain managedDomain) bool {
+			return strings.EqualFold(record.Name, domain.FQDN) && domain.manages(record.Type)
+		})
+		if isManaged {
+			continue
+		}
+
+		for _, change := range changes {
+			if record.Type != change.recordType() {
+				continue
+			}
+
+			newContent, affected := change.rewrite(record.Content)
+			if !affected {
+				continue
+			}
+
+			if len(markers) > 0 && !slices.Contains(markers, record.Notes) {
+				logger.Warnf("Sweep: ignoring foreign %s-Record of %s pointing to %s because it's not tagged with an ownership marker.", record.Type, record.Name, record.Content)
+				break
+			}
+
+			if sweepRecord(ctx, zone, record, newContent) != nil {
+				success = false
+			}
+			break
+		}
+	}
+
+	return success
+}
+
+// manages reports whether the regular update keeps the records of recordType of domain up to date.
+func (domain managedDomain) manages(recordType string) bool {
+	switch recordType {
+	case "A":
+		return domain.IPv4
+	case "AAAA":
+		return domain.IPv6 != "false"
+	default:
+		return false
+	}
+}
+
+// sweepRecord points record of zone to newContent. The name, TTL and notes of record are kept.
+// Returns the error of the request, which is already logged.
+func sweepRecord(ctx context.Context, zone zone, record porkbun.Record, newContent string) error {
+	subdomain := ""
+	if len(record.Name) > len(zone.rootDomain) {
+		subdomain = record.Name[:len(record.Name)-len(zone.rootDomain)-1]
+	}
+
+	// An unparsable TTL is omitted, then Porkbun uses its default
+	ttl, _ := strconv.Atoi(record.TTL)
+
+	params := porkbun.RecordParams{Name: subdomain, Type: record.Type, Content: newContent, TTL: ttl, Notes: record.Notes}
+
+	err := zone.client.Edit(ctx, zone.rootDomain, record.ID, params)
+	if err != nil {
+		logger.Warnf("Sweep: could not update %s-Record of %s pointing to %s. %s", record.Type, record.Name, record.Content, err)
+		return err
+	}
+
+	log.Printf("Sweep: %s-Record of %s updated: %s -> %s.", record.Type, record.Name, record.Content, newContent)
+
+	return nil
+}
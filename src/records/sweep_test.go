@@ -0,0 +1,193 @@
+package records
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bjoernblessin.de/gorkbunddns/src/config"
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
+)
+
+func TestIPChangeRewrite(t *testing.T) {
+	tests := []struct {
+		name             string
+		change           ipChange
+		content          string
+		expected         string
+		expectedAffected bool
+	}{
+		{"IPv4Match", ipChange{ipv4Source, "203.0.113.1", "203.0.113.2"}, "203.0.113.1", "203.0.113.2", true},
+		{"IPv4Other", ipChange{ipv4Source, "203.0.113.1", "203.0.113.2"}, "198.51.100.1", "", false},
+		{"PrefixMatch", ipChange{config.IPv6PrefixOnlyValue, "2001:db8:1:1200::/56", "2001:db8:2:3400::/56"}, "2001:db8:1:121a:211:32ff:fe12:3456", "2001:db8:2:341a:211:32ff:fe12:3456", true},
+		{"PrefixOther", ipChange{config.IPv6PrefixOnlyValue, "2001:db8:1:1200::/56", "2001:db8:2:3400::/56"}, "2001:db8:9::1", "", false},
+		{"HostIPMatchesOld64", ipChange{config.IPv6HostIPValue, "2001:db8:1:1::10", "2001:db8:2:2::10"}, "2001:db8:1:1::20", "2001:db8:2:2::20", true},
+		{"HostIPOther64", ipChange{config.IPv6HostIPValue, "2001:db8:1:1::10", "2001:db8:2:2::10"}, "2001:db8:1:2::20", "", false},
+		{"NotAnIP", ipChange{config.IPv6HostIPValue, "2001:db8:1:1::10", "2001:db8:2:2::10"}, "example.com", "", false},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			result, affected := testcase.change.rewrite(testcase.content)
+			if affected != testcase.expectedAffected || (affected && result != testcase.expected) {
+				t.Errorf("expected: %s (%t), got: %s (%t)", testcase.expected, testcase.expectedAffected, result, affected)
+			}
+		})
+	}
+}
+
+func TestUpdaterSweep(t *testing.T) {
+	writes := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dns/retrieve/example.com" {
+			w.Write([]byte(`{"status":"SUCCESS","records":[
+				{"id":"1","name":"example.com","type":"A","content":"203.0.113.1","ttl":"600"},
+				{"id":"2","name":"mail.example.com","type":"A","content":"203.0.113.1","ttl":"600"},
+				{"id":"3","name":"other.example.com","type":"A","content":"198.51.100.1","ttl":"600"},
+				{"id":"4","name":"nas.example.com","type":"AAAA","content":"2001:db8:1:1::1","ttl":"600"},
+				{"id":"5","name":"www.example.com","type":"CNAME","content":"example.com","ttl":"600"}
+			]}`))
+			return
+		}
+
+		writes[r.URL.Path]++
+		w.Write([]byte(`{"status":"SUCCESS"}`))
+	}))
+	defer server.Close()
+
+	credentials := config.Credentials{APIKey: "pk1_test", SecretKey: "sk1_test"}
+	cfg := &config.Config{
+		Sweep:   true,
+		Domains: []config.Domain{{FQDN: "example.com", RootDomain: "example.com", Credentials: credentials, IPv4: true, IPv6: "false"}},
+	}
+	clients := map[config.Credentials]*porkbun.Client{credentials: porkbun.NewClient(server.URL, server.Client(), credentials.APIKey, credentials.SecretKey)}
+
+	updater := NewUpdater(cfg, clients)
+	currentIPv4 := "203.0.113.1"
+	updater.fetch = func(ctx context.Context, source string) (string, error) { return currentIPv4, nil }
+
+	// The first update only remembers the IP
+	updater.Update(context.Background())
+	if len(writes) != 0 {
+		t.Fatalf("expected no writes, got: %v", writes)
+	}
+
+	currentIPv4 = "203.0.113.2"
+	updater.Update(context.Background())
+
+	// The managed record is edited by the regular update, mail.example.com by the sweep
+	expected := map[string]int{"/dns/edit/example.com/1": 1, "/dns/edit/example.com/2": 1}
+	if !maps.Equal(writes, expected) {
+		t.Errorf("expected writes: %v, got: %v", expected, writes)
+	}
+}
+
+func TestUpdaterSweepRepeatsFailedSweeps(t *testing.T) {
+	tests := []struct {
+		name        string
+		failingPath string
+	}{
+		{"RetrievalFailed", "/dns/retrieve/example.com"},
+		{"EditFailed", "/dns/edit/example.com/2"},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			failing := false
+			writes := map[string]int{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing && r.URL.Path == testcase.failingPath {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+
+				if r.URL.Path == "/dns/retrieve/example.com" {
+					w.Write([]byte(`{"status":"SUCCESS","records":[
+						{"id":"1","name":"example.com","type":"A","content":"203.0.113.2","ttl":"600"},
+						{"id":"2","name":"mail.example.com","type":"A","content":"203.0.113.1","ttl":"600"}
+					]}`))
+					return
+				}
+
+				writes[r.URL.Path]++
+				w.Write([]byte(`{"status":"SUCCESS"}`))
+			}))
+			defer server.Close()
+
+			credentials := config.Credentials{APIKey: "pk1_test", SecretKey: "sk1_test"}
+			cfg := &config.Config{
+				Sweep:   true,
+				Domains: []config.Domain{{FQDN: "example.com", RootDomain: "example.com", Credentials: credentials, IPv4: true, IPv6: "false"}},
+			}
+			client := porkbun.NewClient(server.URL, server.Client(), credentials.APIKey, credentials.SecretKey)
+			client.SetRetryPolicy(porkbun.RetryPolicy{MaxAttempts: 1})
+
+			updater := NewUpdater(cfg, map[config.Credentials]*porkbun.Client{credentials: client})
+			currentIPv4 := "203.0.113.1"
+			updater.fetch = func(ctx context.Context, source string) (string, error) { return currentIPv4, nil }
+
+			updater.Update(context.Background())
+
+			// The sweep after the IP change fails
+			currentIPv4 = "203.0.113.2"
+			failing = true
+			updater.Update(context.Background())
+
+			failing = false
+			writes["/dns/edit/example.com/2"] = 0
+			updater.Update(context.Background())
+
+			if writes["/dns/edit/example.com/2"] != 1 {
+				t.Errorf("expected mail.example.com to be swept by the next update, got writes: %v", writes)
+			}
+		})
+	}
+}
+
+func TestSweepZoneStrictOwnership(t *testing.T) {
+	writes := map[string]int{}
+	client := fakePorkbunServer(t, writes)
+
+	zone := zone{rootDomain: "example.com", client: client, domains: []managedDomain{
+		{config.Domain{FQDN: "example.com", RootDomain: "example.com", Notes: "gorkbun", StrictOwnership: true}},
+	}}
+	zoneRecords := []porkbun.Record{
+		{ID: "1", Name: "mail.example.com", Type: "A", Content: "203.0.113.1", Notes: "gorkbun"},
+		{ID: "2", Name: "shop.example.com", Type: "A", Content: "203.0.113.1"},
+	}
+
+	success := sweepZone(context.Background(), zone, zoneRecords, []ipChange{{source: ipv4Source, oldIP: "203.0.113.1", newIP: "203.0.113.2"}})
+
+	// The untagged record belongs to someone else
+	expected := map[string]int{"/dns/edit/example.com/1": 1}
+	if !success || !maps.Equal(writes, expected) {
+		t.Errorf("expected writes: %v, got: %v", expected, writes)
+	}
+}
+
+func TestSweepZoneUnmanagedRecordType(t *testing.T) {
+	writes := map[string]int{}
+	client := fakePorkbunServer(t, writes)
+
+	// nas.example.com only has IPv4 updates, so its AAAA-Record is only rewritten by the sweep
+	zone := zone{rootDomain: "example.com", client: client, domains: []managedDomain{
+		{config.Domain{FQDN: "nas.example.com", Subdomain: "nas", RootDomain: "example.com", IPv4: true, IPv6: "false"}},
+	}}
+	zoneRecords := []porkbun.Record{
+		{ID: "1", Name: "nas.example.com", Type: "A", Content: "203.0.113.1"},
+		{ID: "2", Name: "nas.example.com", Type: "AAAA", Content: "2001:db8:1:121a:211:32ff:fe12:3456"},
+	}
+	changes := []ipChange{
+		{source: ipv4Source, oldIP: "203.0.113.1", newIP: "203.0.113.2"},
+		{source: config.IPv6PrefixOnlyValue, oldIP: "2001:db8:1:1200::/56", newIP: "2001:db8:2:3400::/56"},
+	}
+
+	success := sweepZone(context.Background(), zone, zoneRecords, changes)
+
+	expected := map[string]int{"/dns/edit/example.com/2": 1}
+	if !success || !maps.Equal(writes, expected) {
+		t.Errorf("expected writes: %v, got: %v", expected, writes)
+	}
+}
@@ -0,0 +1,124 @@
+package records
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"bjoernblessin.de/gorkbunddns/src/config"
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
+)
+
+// ValidateDomains checks all configured domains and prints a report per root domain.
+// Each root domain must belong to the Porkbun account of its API key pair and must have API access enabled.
+// clients must contain a client for every API key pair of cfg.
+// Returns false if at least one definite problem was found, e.g. the domains of an account couldn't be listed. Root domains that can't be checked
+// because of transient errors (see porkbun.IsTransient) are reported but don't count as problems, the updates will report them again if they persist.
+func ValidateDomains(ctx context.Context, cfg *config.Config, clients map[config.Credentials]*porkbun.Client) bool {
+	accountDomains := map[*porkbun.Client][]porkbun.Domain{}
+	listErrs := map[*porkbun.Client]error{}
+
+	for _, credentials := range cfg.AllCredentials() {
+		client := clients[credentials]
+
+		domains, err := client.ListDomains(ctx)
+		if err != nil {
+			listErrs[client] = err
+			continue
+		}
+
+		accountDomains[client] = domains
+	}
+
+	report := checkZones(ctx, groupByRootDomain(cfg.Domains, clients), accountDomains, listErrs)
+
+	log.Printf("Domain report:")
+	valid := true
+	for _, line := range report {
+		log.Printf("  %s", line)
+		valid = valid && line.err == nil
+	}
+
+	return valid
+}
+
+// zoneReport is the result of checking one root domain.
+type zoneReport struct {
+	zone zone
+	err  error
+	// uncheckedErr is set instead of err if the root domain couldn't be checked because of a transient error.
+	uncheckedErr error
+}
+
+func (r zoneReport) String() string {
+	var names []string
+	for _, domain := range r.zone.domains {
+		if domain.Entry != domain.FQDN {
+			names = append(names, fmt.Sprintf("%s (%s)", domain.Entry, domain.FQDN))
+		} else {
+			names = append(names, domain.FQDN)
+		}
+	}
+
+	if r.err != nil {
+		return fmt.Sprintf("%s: ERROR, %s Affected: %s", r.zone.rootDomain, r.err, strings.Join(names, ", "))
+	}
+
+	if r.uncheckedErr != nil {
+		return fmt.Sprintf("%s: UNCHECKED, %s Affected: %s", r.zone.rootDomain, r.uncheckedErr, strings.Join(names, ", "))
+	}
+
+	return fmt.Sprintf("%s: OK, API access enabled. Managed: %s", r.zone.rootDomain, strings.Join(names, ", "))
+}
+
+// checkZones checks that every zone belongs to the account domains of its client and that its records can be retrieved.
+// Zones of clients missing in accountDomains are reported with the error of listErrs, as unchecked if it is transient.
+func checkZones(ctx context.Context, zones []zone, accountDomains map[*porkbun.Client][]porkbun.Domain, listErrs map[*porkbun.Client]error) []zoneReport {
+	owned := map[*porkbun.Client]map[string]bool{}
+	for client, domains := range accountDomains {
+		owned[client] = map[string]bool{}
+		for _, accountDomain := range domains {
+			owned[client][strings.ToLower(accountDomain.Domain)] = true
+		}
+	}
+
+	var reports []zoneReport
+
+	for _, zone := range zones {
+		report := zoneReport{zone: zone}
+
+		ownedDomains, listed := owned[zone.client]
+		if !listed {
+			err := fmt.Errorf("the domains of the Porkbun account couldn't be listed. %w", listErrs[zone.client])
+			if porkbun.IsTransient(listErrs[zone.client]) {
+				report.uncheckedErr = err
+			} else {
+				report.err = err
+			}
+			reports = append(reports, report)
+			continue
+		}
+
+		if !ownedDomains[strings.ToLower(zone.rootDomain)] {
+			report.err = errors.New("not found in the Porkbun account of the API key.")
+			reports = append(reports, report)
+			continue
+		}
+
+		_, err := zone.client.Retrieve(ctx, zone.rootDomain)
+		switch {
+		case errors.Is(err, porkbun.ErrAPIAccessDisabled):
+			report.err = errors.New("API access is not enabled. Please enable it on Porkbun's domain management site.")
+		case porkbun.IsTransient(err):
+			report.uncheckedErr = fmt.Errorf("retrieving the records failed temporarily. %w", err)
+		case err != nil:
+			report.err = fmt.Errorf("retrieving the records failed. %w", err)
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports
+}
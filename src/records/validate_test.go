@@ -0,0 +1,132 @@
+package records
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bjoernblessin.de/gorkbunddns/src/config"
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
+)
+
+func TestValidateDomains(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/domain/listAll":
+			w.Write([]byte(`{"status":"SUCCESS","domains":[{"domain":"example.com","status":"ACTIVE"},{"domain":"example.org","status":"ACTIVE"}]}`))
+		case "/dns/retrieve/example.com":
+			w.Write([]byte(`{"status":"SUCCESS","records":[]}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"ERROR","message":"Domain is not opted in to API access."}`))
+		}
+	}))
+	defer server.Close()
+
+	credentials := config.Credentials{APIKey: "pk1_test", SecretKey: "sk1_test"}
+	clients := map[config.Credentials]*porkbun.Client{
+		credentials: porkbun.NewClient(server.URL, server.Client(), credentials.APIKey, credentials.SecretKey),
+	}
+
+	tests := []struct {
+		name        string
+		rootDomains []string
+		expected    bool
+	}{
+		{"Valid", []string{"example.com", "example.com"}, true},
+		{"NotInAccount", []string{"example.com", "example.net"}, false},
+		{"APIAccessDisabled", []string{"example.org"}, false},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			for _, rootDomain := range testcase.rootDomains {
+				cfg.Domains = append(cfg.Domains, config.Domain{Entry: rootDomain, FQDN: rootDomain, RootDomain: rootDomain, Credentials: credentials})
+			}
+
+			if ValidateDomains(context.Background(), cfg, clients) != testcase.expected {
+				t.Errorf("expected: %t", testcase.expected)
+			}
+		})
+	}
+}
+
+func TestValidateDomainsTransientFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		failingPath string
+	}{
+		{"ListDomains", "/domain/listAll"},
+		{"Retrieve", "/dns/retrieve/example.com"},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case testcase.failingPath:
+					w.WriteHeader(http.StatusServiceUnavailable)
+				case "/domain/listAll":
+					w.Write([]byte(`{"status":"SUCCESS","domains":[{"domain":"example.com","status":"ACTIVE"}]}`))
+				default:
+					w.Write([]byte(`{"status":"SUCCESS","records":[]}`))
+				}
+			}))
+			defer server.Close()
+
+			credentials := config.Credentials{APIKey: "pk1_test", SecretKey: "sk1_test"}
+			client := porkbun.NewClient(server.URL, server.Client(), credentials.APIKey, credentials.SecretKey)
+			client.SetRetryPolicy(porkbun.RetryPolicy{MaxAttempts: 1})
+
+			cfg := &config.Config{Domains: []config.Domain{{Entry: "example.com", FQDN: "example.com", RootDomain: "example.com", Credentials: credentials}}}
+
+			// An unavailable Porkbun server says nothing about the domains
+			if !ValidateDomains(context.Background(), cfg, map[config.Credentials]*porkbun.Client{credentials: client}) {
+				t.Errorf("expected the domains to be accepted")
+			}
+		})
+	}
+}
+
+func TestValidateDomainsListFailure(t *testing.T) {
+	invalidServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"ERROR","message":"Invalid API key. (002)"}`))
+	}))
+	defer invalidServer.Close()
+
+	retrieved := 0
+	validServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/domain/listAll":
+			w.Write([]byte(`{"status":"SUCCESS","domains":[{"domain":"example.org","status":"ACTIVE"}]}`))
+		default:
+			retrieved++
+			w.Write([]byte(`{"status":"SUCCESS","records":[]}`))
+		}
+	}))
+	defer validServer.Close()
+
+	invalidCredentials := config.Credentials{APIKey: "pk1_invalid", SecretKey: "sk1_invalid"}
+	validCredentials := config.Credentials{APIKey: "pk1_valid", SecretKey: "sk1_valid"}
+	clients := map[config.Credentials]*porkbun.Client{
+		invalidCredentials: porkbun.NewClient(invalidServer.URL, invalidServer.Client(), invalidCredentials.APIKey, invalidCredentials.SecretKey),
+		validCredentials:   porkbun.NewClient(validServer.URL, validServer.Client(), validCredentials.APIKey, validCredentials.SecretKey),
+	}
+
+	cfg := &config.Config{Domains: []config.Domain{
+		{Entry: "example.com", FQDN: "example.com", RootDomain: "example.com", Credentials: invalidCredentials},
+		{Entry: "example.org", FQDN: "example.org", RootDomain: "example.org", Credentials: validCredentials},
+	}}
+
+	if ValidateDomains(context.Background(), cfg, clients) {
+		t.Errorf("expected the domains to be rejected")
+	}
+
+	// The domains of the other account are checked anyway
+	if retrieved != 1 {
+		t.Errorf("expected the records of example.org to be retrieved once, got: %d", retrieved)
+	}
+}
@@ -0,0 +1,197 @@
+package wanip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const DNSSourceName = "dns"
+
+// DNSQueryTypeIP asks for the A-Record (IPv4) or AAAA-Record (IPv6) of the query name, which contains the address of the client.
+const DNSQueryTypeIP = "ip"
+
+// DNSQueryTypeTXT asks for the TXT-Record of the query name, whose first string that is an address of the family is used.
+const DNSQueryTypeTXT = "txt"
+
+// DefaultDNSQueries are asked by the dns source if no queries are configured. The resolvers are reachable via IPv4 and IPv6.
+var DefaultDNSQueries = []DNSQuery{
+	{Type: DNSQueryTypeIP, Name: "myip.opendns.com", Resolver: "resolver1.opendns.com:53"},
+	{Type: DNSQueryTypeTXT, Name: "o-o.myaddr.l.google.com", Resolver: "ns1.google.com:53"},
+}
+
+// dnsTimeouts are the retransmission intervals of a single DNS query.
+var dnsTimeouts = []time.Duration{time.Second, 2 * time.Second, 2 * time.Second}
+
+// DNSQuery is a DNS lookup that returns the public address of the client, e.g. myip.opendns.com against resolver1.opendns.com.
+type DNSQuery struct {
+	// Type is either DNSQueryTypeIP or DNSQueryTypeTXT.
+	Type string
+	Name string
+	// Resolver is the host:port address of the DNS server that is asked.
+	Resolver string
+}
+
+// ParseDNSQuery parses a query of the form "type:name@resolver", e.g. "txt:o-o.myaddr.l.google.com@ns1.google.com".
+// The port of the resolver defaults to 53.
+func ParseDNSQuery(s string) (DNSQuery, error) {
+	queryType, rest, foundType := strings.Cut(s, ":")
+	name, resolver, foundResolver := strings.Cut(rest, "@")
+
+	if !foundType || !foundResolver || name == "" || resolver == "" {
+		return DNSQuery{}, fmt.Errorf("%q must have the form type:name@resolver.", s)
+	}
+
+	if queryType != DNSQueryTypeIP && queryType != DNSQueryTypeTXT {
+		return DNSQuery{}, fmt.Errorf("Query type of %q must be %s or %s.", s, DNSQueryTypeIP, DNSQueryTypeTXT)
+	}
+
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+	}
+
+	_, err := dnsmessage.NewName(dnsName(name))
+	if err != nil {
+		return DNSQuery{}, fmt.Errorf("Invalid query name in %q.", s)
+	}
+
+	return DNSQuery{Type: queryType, Name: name, Resolver: resolver}, nil
+}
+
+func (q DNSQuery) String() string {
+	return fmt.Sprintf("%s:%s@%s", q.Type, q.Name, q.Resolver)
+}
+
+// dnsName returns name as fully qualified DNS name with trailing dot.
+func dnsName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+
+	return name + "."
+}
+
+// dnsSource performs DNS lookups that return the public address of the client. The queries are asked in order until one succeeds.
+type dnsSource struct {
+	family  Family
+	queries []DNSQuery
+}
+
+func (s dnsSource) Name() string {
+	return DNSSourceName
+}
+
+func (s dnsSource) IP(ctx context.Context) (netip.Addr, error) {
+	if len(s.queries) == 0 {
+		return netip.Addr{}, fmt.Errorf("No DNS queries configured.")
+	}
+
+	var errs []error
+
+	for _, query := range s.queries {
+		ip, err := lookupOwnIP(ctx, s.family, query)
+		if err == nil {
+			return ip, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", query, err))
+	}
+
+	return netip.Addr{}, errors.Join(errs...)
+}
+
+// lookupOwnIP sends query to its resolver via UDP over family, so that the resolver sees the address of family.
+func lookupOwnIP(ctx context.Context, family Family, query DNSQuery) (netip.Addr, error) {
+	network := "udp4"
+	recordType := dnsmessage.TypeA
+	if family == IPv6 {
+		network = "udp6"
+		recordType = dnsmessage.TypeAAAA
+	}
+	if query.Type == DNSQueryTypeTXT {
+		recordType = dnsmessage.TypeTXT
+	}
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, network, query.Resolver)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Could not open UDP socket to resolver. %w", err)
+	}
+	defer conn.Close()
+
+	name, err := dnsmessage.NewName(dnsName(query.Name))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Invalid query name %q.", query.Name)
+	}
+
+	id := uint16(rand.Uint32())
+	request := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: recordType, Class: dnsmessage.ClassINET}},
+	}
+
+	requestBytes, err := request.Pack()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Could not build DNS query. %w", err)
+	}
+
+	var ip netip.Addr
+
+	err = exchange(ctx, conn.(*net.UDPConn), requestBytes, dnsTimeouts, func(response []byte) (bool, error) {
+		var message dnsmessage.Message
+
+		err := message.Unpack(response)
+		if err != nil || message.ID != id || !message.Response {
+			return false, nil
+		}
+
+		ip, err = parseDNSAnswer(message, family)
+		return true, err
+	})
+
+	return ip, err
+}
+
+// parseDNSAnswer returns the first address of family in the answers of message.
+func parseDNSAnswer(message dnsmessage.Message, family Family) (netip.Addr, error) {
+	if message.RCode != dnsmessage.RCodeSuccess {
+		return netip.Addr{}, fmt.Errorf("Resolver responded with %s.", message.RCode)
+	}
+
+	if message.Truncated {
+		return netip.Addr{}, fmt.Errorf("Resolver responded with a truncated answer.")
+	}
+
+	for _, answer := range message.Answers {
+		var ip netip.Addr
+
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = netip.AddrFrom4(body.A)
+		case *dnsmessage.AAAAResource:
+			ip = netip.AddrFrom16(body.AAAA)
+		case *dnsmessage.TXTResource:
+			// E.g. Google adds "edns0-client-subnet 192.0.2.0/24" if the query went through a public resolver
+			for _, txt := range body.TXT {
+				if addr, err := netip.ParseAddr(strings.TrimSpace(txt)); err == nil {
+					ip = addr.Unmap()
+					break
+				}
+			}
+		}
+
+		if ip.IsValid() && ip.Is4() == (family == IPv4) {
+			return ip, nil
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("Resolver responded without an %s address.", family)
+}
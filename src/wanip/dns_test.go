@@ -0,0 +1,128 @@
+package wanip
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSServer starts a DNS server on 127.0.0.1 that answers A queries for myip.example.com with ip
+// and TXT queries for whoami.example.com with an EDNS client subnet note followed by ip. Other names don't exist.
+// Returns its address.
+func fakeDNSServer(t *testing.T, ip string) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1100)
+		for {
+			n, remoteAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			var request dnsmessage.Message
+			if request.Unpack(buffer[:n]) != nil || len(request.Questions) != 1 {
+				continue
+			}
+
+			question := request.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: request.ID, Response: true, Authoritative: true},
+				Questions: request.Questions,
+			}
+			header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 0}
+
+			switch {
+			case question.Name.String() == "myip.example.com." && question.Type == dnsmessage.TypeA:
+				response.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()}}}
+			case question.Name.String() == "whoami.example.com." && question.Type == dnsmessage.TypeTXT:
+				response.Answers = []dnsmessage.Resource{
+					{Header: header, Body: &dnsmessage.TXTResource{TXT: []string{"edns0-client-subnet 192.0.2.0/24"}}},
+					{Header: header, Body: &dnsmessage.TXTResource{TXT: []string{ip}}},
+				}
+			default:
+				response.RCode = dnsmessage.RCodeNameError
+			}
+
+			responseBytes, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(responseBytes, remoteAddr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestDNSSource(t *testing.T) {
+	resolver := fakeDNSServer(t, "203.0.113.7")
+
+	tests := []struct {
+		name    string
+		queries []DNSQuery
+	}{
+		{"A", []DNSQuery{{Type: DNSQueryTypeIP, Name: "myip.example.com", Resolver: resolver}}},
+		{"TXT", []DNSQuery{{Type: DNSQueryTypeTXT, Name: "whoami.example.com.", Resolver: resolver}}},
+		{"Fallback", []DNSQuery{{Type: DNSQueryTypeIP, Name: "nonexistent.example.com", Resolver: resolver}, {Type: DNSQueryTypeIP, Name: "myip.example.com", Resolver: resolver}}},
+	}
+
+	for _, test := range tests {
+		ip, err := dnsSource{family: IPv4, queries: test.queries}.IP(context.Background())
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if ip.String() != "203.0.113.7" {
+			t.Errorf("%s: expected: 203.0.113.7, got: %s", test.name, ip)
+		}
+	}
+
+	_, err := dnsSource{family: IPv4, queries: []DNSQuery{{Type: DNSQueryTypeIP, Name: "nonexistent.example.com", Resolver: resolver}}}.IP(context.Background())
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"ip:myip.opendns.com@resolver1.opendns.com", "ip:myip.opendns.com@resolver1.opendns.com:53"},
+		{"txt:o-o.myaddr.l.google.com@ns1.google.com:5353", "txt:o-o.myaddr.l.google.com@ns1.google.com:5353"},
+		{"ip:myip.opendns.com@2620:119:35::35", "ip:myip.opendns.com@[2620:119:35::35]:53"},
+		{"ip:myip.opendns.com@[2620:119:35::35]:53", "ip:myip.opendns.com@[2620:119:35::35]:53"},
+		{"a:myip.opendns.com@resolver1.opendns.com", ""},
+		{"ip:myip.opendns.com", ""},
+		{"myip.opendns.com@resolver1.opendns.com", ""},
+	}
+
+	for _, test := range tests {
+		query, err := ParseDNSQuery(test.query)
+
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got: %s", test.query, query)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.query, err)
+			continue
+		}
+
+		if query.String() != test.expected {
+			t.Errorf("expected: %s, got: %s", test.expected, query)
+		}
+	}
+}
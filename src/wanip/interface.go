@@ -0,0 +1,199 @@
+package wanip
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const InterfaceSourceName = "interface"
+
+// Flags of an IPv6 address in /proc/net/if_inet6, see IFA_F_* in linux/if_addr.h.
+const (
+	ifaFlagTemporary  = 0x01
+	ifaFlagOptimistic = 0x04
+	ifaFlagDADFailed  = 0x08
+	ifaFlagDeprecated = 0x20
+	ifaFlagTentative  = 0x40
+)
+
+// unstableIPv6Flags mark addresses that are about to change or not usable yet.
+const unstableIPv6Flags = ifaFlagTemporary | ifaFlagOptimistic | ifaFlagDADFailed | ifaFlagDeprecated | ifaFlagTentative
+
+// interfaceSource reads the address directly from a network interface of the host instead of asking another device.
+type interfaceSource struct {
+	family Family
+	// name of the interface, e.g. "eth0" or "ppp0". Empty means all interfaces.
+	name string
+	// inet6File lists the IPv6 addresses with their flags, "/proc/net/if_inet6" except in tests.
+	inet6File string
+}
+
+func (s interfaceSource) Name() string {
+	return InterfaceSourceName
+}
+
+func (s interfaceSource) IP(ctx context.Context) (netip.Addr, error) {
+	if s.family == IPv6 {
+		return s.ipv6()
+	}
+
+	return s.ipv4()
+}
+
+// description returns the interface(s) s reads from for error messages.
+func (s interfaceSource) description() string {
+	if s.name == "" {
+		return "any interface"
+	}
+
+	return "interface " + s.name
+}
+
+// ipv4 returns the first public IPv4 of the interface (or of any interface that is up).
+func (s interfaceSource) ipv4() (netip.Addr, error) {
+	var interfaces []net.Interface
+
+	if s.name != "" {
+		iface, err := net.InterfaceByName(s.name)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("Interface %s not found. %w", s.name, err)
+		}
+		interfaces = []net.Interface{*iface}
+	} else {
+		var err error
+		interfaces, err = net.Interfaces()
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("Could not list network interfaces. %w", err)
+		}
+	}
+
+	var candidates []netip.Addr
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			ip, _ := netip.AddrFromSlice(ipNet.IP)
+			candidates = append(candidates, ip.Unmap())
+		}
+	}
+
+	ip, found := selectPublicIPv4(candidates, s.name != "")
+	if !found {
+		return netip.Addr{}, fmt.Errorf("No public IPv4 on %s.", s.description())
+	}
+
+	return ip, nil
+}
+
+// selectPublicIPv4 returns the first address of candidates that passes validate.
+// Carrier-grade NAT addresses are only returned by a single configured interface, so that the chain reports ErrCGNAT for it.
+// Across all interfaces they usually belong to a VPN like Tailscale rather than to the WAN connection, so they are skipped.
+func selectPublicIPv4(candidates []netip.Addr, singleInterface bool) (netip.Addr, bool) {
+	var cgnat []netip.Addr
+
+	for _, ip := range candidates {
+		err := validate(ip, IPv4)
+		if err == nil {
+			return ip, true
+		}
+
+		if errors.Is(err, ErrCGNAT) {
+			cgnat = append(cgnat, ip)
+		}
+	}
+
+	if singleInterface && len(cgnat) > 0 {
+		return cgnat[0], true
+	}
+
+	return netip.Addr{}, false
+}
+
+// ipv6 returns the most stable global IPv6 of the interface (or of any interface).
+func (s interfaceSource) ipv6() (netip.Addr, error) {
+	file, err := os.Open(s.inet6File)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Could not read IPv6 addresses. %w", err)
+	}
+	defer file.Close()
+
+	ip, found := selectStableIPv6(file, s.name)
+	if !found {
+		return netip.Addr{}, fmt.Errorf("No stable global IPv6 on %s.", s.description())
+	}
+
+	return ip, nil
+}
+
+// selectStableIPv6 selects an address of interfaceName (or of any interface if empty) from inet6, which has the format of /proc/net/if_inet6.
+// Temporary (RFC 4941), deprecated, tentative, unique local and link-local addresses are skipped.
+// EUI-64 addresses are preferred, then other stable addresses like stable privacy (RFC 7217), DHCPv6 or static addresses.
+func selectStableIPv6(inet6 io.Reader, interfaceName string) (netip.Addr, bool) {
+	var eui64, other []netip.Addr
+
+	scanner := bufio.NewScanner(inet6)
+	for scanner.Scan() {
+		// Address Index PrefixLength Scope Flags Name
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || (interfaceName != "" && fields[5] != interfaceName) {
+			continue
+		}
+
+		addressBytes, err := hex.DecodeString(fields[0])
+		if err != nil || len(addressBytes) != 16 {
+			continue
+		}
+		ip := netip.AddrFrom16([16]byte(addressBytes))
+
+		flags, err := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil || flags&unstableIPv6Flags != 0 {
+			continue
+		}
+
+		if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			continue
+		}
+
+		if isEUI64(ip) {
+			eui64 = append(eui64, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+
+	candidates := slices.Concat(eui64, other)
+	if len(candidates) == 0 {
+		return netip.Addr{}, false
+	}
+
+	return candidates[0], true
+}
+
+// isEUI64 reports whether the interface ID of ip is derived from a MAC address, i.e. contains ff:fe in the middle.
+func isEUI64(ip netip.Addr) bool {
+	bytes := ip.As16()
+	return bytes[11] == 0xff && bytes[12] == 0xfe
+}
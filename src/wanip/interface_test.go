@@ -0,0 +1,115 @@
+package wanip
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// inet6 is an /proc/net/if_inet6 of a host with privacy extensions enabled on eth0 and a WireGuard interface.
+const inet6 = `fe80000000000000021132fffe123456 02 40 20 80     eth0
+20010db8000100000000000000000042 02 40 00 01     eth0
+20010db80001000002113200fe123456 02 40 00 20     eth0
+fd000000000000000000000000000001 02 40 00 80     eth0
+20010db80001000002113a4b5c6d7e8f 02 40 00 00     eth0
+20010db800010000021132fffe123456 02 40 00 00     eth0
+20010db80002000000000000000000aa 03 40 00 40      wg0
+20010db80002000000000000000000bb 03 40 00 80      wg0
+00000000000000000000000000000001 01 80 10 80       lo
+`
+
+func TestSelectStableIPv6(t *testing.T) {
+	tests := []struct {
+		interfaceName string
+		expected      string
+	}{
+		// EUI-64 wins over the stable privacy address, the temporary and the deprecated address are skipped
+		{"eth0", "2001:db8:1:0:211:32ff:fe12:3456"},
+		// The tentative address is skipped
+		{"wg0", "2001:db8:2::bb"},
+		{"", "2001:db8:1:0:211:32ff:fe12:3456"},
+		{"lo", ""},
+		{"ppp0", ""},
+	}
+
+	for _, test := range tests {
+		ip, found := selectStableIPv6(strings.NewReader(inet6), test.interfaceName)
+
+		if test.expected == "" {
+			if found {
+				t.Errorf("%s: expected no address, got: %s", test.interfaceName, ip)
+			}
+			continue
+		}
+
+		if ip.String() != test.expected {
+			t.Errorf("%s: expected: %s, got: %s", test.interfaceName, test.expected, ip)
+		}
+	}
+}
+
+func TestSelectPublicIPv4(t *testing.T) {
+	tests := []struct {
+		name            string
+		candidates      []string
+		singleInterface bool
+		expected        string
+	}{
+		{"Public", []string{"192.168.178.20", "84.150.23.42"}, false, "84.150.23.42"},
+		// tailscale0 comes before the WAN interface
+		{"SkipsTailscale", []string{"100.101.102.103", "84.150.23.42"}, false, "84.150.23.42"},
+		{"OnlyTailscale", []string{"10.0.0.2", "100.101.102.103"}, false, ""},
+		{"SkipsBogons", []string{"203.0.113.7", "198.18.0.1", "84.150.23.42"}, false, "84.150.23.42"},
+		// The configured interface is behind carrier-grade NAT, which the chain reports
+		{"CGNATOnInterface", []string{"100.64.12.34"}, true, "100.64.12.34"},
+		{"PublicOverCGNATOnInterface", []string{"100.64.12.34", "84.150.23.42"}, true, "84.150.23.42"},
+	}
+
+	for _, test := range tests {
+		var candidates []netip.Addr
+		for _, candidate := range test.candidates {
+			candidates = append(candidates, netip.MustParseAddr(candidate))
+		}
+
+		ip, found := selectPublicIPv4(candidates, test.singleInterface)
+
+		if test.expected == "" {
+			if found {
+				t.Errorf("%s: expected no address, got: %s", test.name, ip)
+			}
+			continue
+		}
+
+		if ip.String() != test.expected {
+			t.Errorf("%s: expected: %s, got: %s", test.name, test.expected, ip)
+		}
+	}
+}
+
+func TestInterfaceSourceIPv6(t *testing.T) {
+	inet6File := filepath.Join(t.TempDir(), "if_inet6")
+
+	err := os.WriteFile(inet6File, []byte(inet6), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := interfaceSource{family: IPv6, name: "wg0", inet6File: inet6File}.IP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "2001:db8:2::bb" {
+		t.Errorf("expected: 2001:db8:2::bb, got: %s", ip)
+	}
+}
+
+func TestInterfaceSourceUnknownInterface(t *testing.T) {
+	_, err := interfaceSource{family: IPv4, name: "nonexistent0"}.IP(context.Background())
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,269 @@
+package wanip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const NATPMPSourceName = "natpmp"
+
+// natpmpPort is the UDP port NAT-PMP (RFC 6886) and PCP (RFC 6887) servers listen on.
+const natpmpPort = 5351
+
+// natpmpTimeout is how long NAT-PMP is tried before falling back to PCP, which allows 4 transmissions.
+// RFC 6886 allows up to 9 transmissions (64 seconds), which is more than sourceTimeout. The README documents the truncation.
+const natpmpTimeout = 4 * time.Second
+
+// pcpMappingLifetime is the requested lifetime in seconds of the UDP mapping a PCP MAP request creates as side effect.
+const pcpMappingLifetime = 120
+
+// errUnsupportedVersion means that the server doesn't speak the protocol version of the request.
+var errUnsupportedVersion = errors.New("Unsupported version.")
+
+// natpmpSource asks the default gateway for its external IPv4 via NAT-PMP, falling back to PCP.
+type natpmpSource struct {
+	// routeFile is the routing table the gateway is read from, "/proc/net/route" except in tests.
+	routeFile string
+	port      int
+}
+
+func (s natpmpSource) Name() string {
+	return NATPMPSourceName
+}
+
+func (s natpmpSource) IP(ctx context.Context) (netip.Addr, error) {
+	gateway, err := readDefaultGateway(s.routeFile)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(gateway, uint16(s.port))))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Could not open UDP socket to gateway %s. %w", gateway, err)
+	}
+	defer conn.Close()
+
+	natpmpCtx, cancel := context.WithTimeout(ctx, natpmpTimeout)
+	ip, natpmpErr := natpmpExternalAddress(natpmpCtx, conn)
+	cancel()
+
+	if natpmpErr == nil {
+		return ip, nil
+	}
+
+	ip, pcpErr := pcpExternalAddress(ctx, conn)
+	if pcpErr != nil {
+		return netip.Addr{}, fmt.Errorf("NAT-PMP: %w PCP: %w", natpmpErr, pcpErr)
+	}
+
+	return ip, nil
+}
+
+// readDefaultGateway returns the gateway of the default route with the lowest metric in the Linux routing table at path.
+func readDefaultGateway(path string) (netip.Addr, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Could not read routing table. %w", err)
+	}
+	defer file.Close()
+
+	return parseDefaultGateway(file)
+}
+
+// parseDefaultGateway parses a routing table in the format of /proc/net/route.
+// Addresses are hexadecimal in host byte order, which is little-endian on all platforms the image is built for.
+func parseDefaultGateway(routes io.Reader) (netip.Addr, error) {
+	const flagGateway = 0x2
+
+	var gateway netip.Addr
+	lowestMetric := -1
+
+	scanner := bufio.NewScanner(routes)
+	scanner.Scan() // Header line
+
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&flagGateway == 0 {
+			continue
+		}
+
+		metric, err := strconv.Atoi(fields[6])
+		if err != nil || (lowestMetric != -1 && metric >= lowestMetric) {
+			continue
+		}
+
+		gatewayBytes, err := hex.DecodeString(fields[2])
+		if err != nil || len(gatewayBytes) != 4 {
+			continue
+		}
+
+		gateway = netip.AddrFrom4([4]byte(binary.BigEndian.AppendUint32(nil, binary.LittleEndian.Uint32(gatewayBytes))))
+		lowestMetric = metric
+	}
+
+	if !gateway.IsValid() {
+		return netip.Addr{}, fmt.Errorf("No default gateway found in the routing table.")
+	}
+
+	return gateway, nil
+}
+
+// natpmpExternalAddress sends a NAT-PMP external address request (RFC 6886 section 3.2).
+// The request is retransmitted after 250ms, doubling the interval each time, up to 9 times.
+func natpmpExternalAddress(ctx context.Context, conn *net.UDPConn) (netip.Addr, error) {
+	request := []byte{0, 0} // Version 0, opcode 0
+
+	var timeouts []time.Duration
+	for i := range 9 {
+		timeouts = append(timeouts, 250*time.Millisecond<<i)
+	}
+
+	var ip netip.Addr
+
+	err := exchange(ctx, conn, request, timeouts, func(response []byte) (bool, error) {
+		// A PCP server answers a NAT-PMP request with its own version (RFC 6887 section 9)
+		if len(response) >= 4 && response[0] != 0 {
+			return true, errUnsupportedVersion
+		}
+
+		if len(response) < 12 || response[1] != 128 {
+			return false, nil
+		}
+
+		resultCode := binary.BigEndian.Uint16(response[2:4])
+		if resultCode == 1 {
+			return true, errUnsupportedVersion
+		}
+		if resultCode != 0 {
+			return true, fmt.Errorf("Gateway responded with result code %d.", resultCode)
+		}
+
+		ip = netip.AddrFrom4([4]byte(response[8:12]))
+		return true, nil
+	})
+
+	return ip, err
+}
+
+// pcpExternalAddress sends a PCP MAP request (RFC 6887 section 11) and returns the assigned external address.
+// The request maps the UDP port of conn for pcpMappingLifetime seconds. It is retransmitted as specified in RFC 6887 section 8.1.1.
+func pcpExternalAddress(ctx context.Context, conn *net.UDPConn) (netip.Addr, error) {
+	localAddr := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+
+	request := make([]byte, 60)
+	request[0] = 2 // Version
+	request[1] = 1 // Opcode MAP
+	binary.BigEndian.PutUint32(request[4:8], pcpMappingLifetime)
+	clientIP := localAddr.Addr().As16() // IPv4-mapped
+	copy(request[8:24], clientIP[:])
+	copy(request[24:36], nonce)
+	request[36] = 17 // UDP
+	binary.BigEndian.PutUint16(request[40:42], localAddr.Port())
+	binary.BigEndian.PutUint16(request[42:44], localAddr.Port())
+	// Suggested external address ::ffff:0.0.0.0 means no preference
+	request[54], request[55] = 0xff, 0xff
+
+	// Initial retransmission time of 3 seconds, doubled up to 1024 seconds, each randomized by ±10 percent.
+	// Only about 2 transmissions fit into the rest of sourceTimeout.
+	var timeouts []time.Duration
+	for retransmission := 3 * time.Second; retransmission <= 1024*time.Second; retransmission *= 2 {
+		timeouts = append(timeouts, time.Duration(float64(retransmission)*(0.9+mathrand.Float64()*0.2)))
+	}
+
+	var ip netip.Addr
+
+	err := exchange(ctx, conn, request, timeouts, func(response []byte) (bool, error) {
+		if len(response) >= 4 && response[0] == 0 {
+			// A NAT-PMP only server
+			return true, errUnsupportedVersion
+		}
+
+		if len(response) < 60 || response[0] != 2 || response[1] != 0x81 || !bytes.Equal(response[24:36], nonce) {
+			return false, nil
+		}
+
+		if resultCode := response[3]; resultCode != 0 {
+			return true, fmt.Errorf("Gateway responded with result code %d.", resultCode)
+		}
+
+		ip = netip.AddrFrom16([16]byte(response[44:60])).Unmap()
+		return true, nil
+	})
+
+	return ip, err
+}
+
+// exchange sends request on conn and passes every received datagram to handle until handle reports it as answer.
+// The request is retransmitted whenever the next duration of timeouts passed without an answer.
+// Returns the error of handle, or an error if no answer arrived in time or ctx is done.
+func exchange(ctx context.Context, conn *net.UDPConn, request []byte, timeouts []time.Duration, handle func(response []byte) (bool, error)) error {
+	buffer := make([]byte, 1100)
+
+	// Interrupts a pending read once ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	for _, timeout := range timeouts {
+		_, err := conn.Write(request)
+		if err != nil {
+			return fmt.Errorf("Sending request failed. %w", err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("No answer from %s. %w", conn.RemoteAddr(), ctx.Err())
+		}
+
+		for {
+			n, err := conn.Read(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if err != nil {
+				// E.g. ICMP port unreachable, the gateway might still answer a retransmission
+				continue
+			}
+
+			if done, err := handle(buffer[:n]); done {
+				return err
+			}
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("No answer from %s. %w", conn.RemoteAddr(), ctx.Err())
+		}
+	}
+
+	return fmt.Errorf("No answer from %s.", conn.RemoteAddr())
+}
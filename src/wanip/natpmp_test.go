@@ -0,0 +1,117 @@
+package wanip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDefaultGateway(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0100A8C0	0003	0	0	100	00000000	0	0	0
+wlan0	00000000	FE01A8C0	0003	0	0	50	00000000	0	0	0
+eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+`
+
+	gateway, err := parseDefaultGateway(strings.NewReader(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gateway.String() != "192.168.1.254" {
+		t.Errorf("expected: 192.168.1.254, got: %s", gateway)
+	}
+
+	_, err = parseDefaultGateway(strings.NewReader("Iface\tDestination\tGateway\n"))
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// fakeGateway starts a UDP server on 127.0.0.1 that answers requests with respond and writes a routing table pointing to it.
+// respond returns nil to ignore a request. Returns the path of the routing table and the port of the server.
+func fakeGateway(t *testing.T, respond func(request []byte) []byte) (string, int) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1100)
+		for {
+			n, remoteAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			if response := respond(buffer[:n]); response != nil {
+				conn.WriteToUDP(response, remoteAddr)
+			}
+		}
+	}()
+
+	routeFile := filepath.Join(t.TempDir(), "route")
+	routes := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"lo\t00000000\t0100007F\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"
+
+	err = os.WriteFile(routeFile, []byte(routes), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return routeFile, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestNATPMPSource(t *testing.T) {
+	routeFile, port := fakeGateway(t, func(request []byte) []byte {
+		if len(request) != 2 || request[0] != 0 || request[1] != 0 {
+			return nil
+		}
+
+		return []byte{0, 128, 0, 0, 0, 0, 0, 42, 203, 0, 113, 7}
+	})
+
+	ip, err := natpmpSource{routeFile: routeFile, port: port}.IP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "203.0.113.7" {
+		t.Errorf("expected: 203.0.113.7, got: %s", ip)
+	}
+}
+
+func TestNATPMPSourcePCPFallback(t *testing.T) {
+	routeFile, port := fakeGateway(t, func(request []byte) []byte {
+		if request[0] == 0 {
+			// Unsupported version
+			return []byte{0, 128, 0, 1, 0, 0, 0, 42, 0, 0, 0, 0}
+		}
+
+		if len(request) != 60 || request[0] != 2 || request[1] != 1 {
+			return nil
+		}
+
+		response := make([]byte, 60)
+		response[0] = 2
+		response[1] = 0x81
+		binary.BigEndian.PutUint32(response[4:8], pcpMappingLifetime)
+		copy(response[24:44], request[24:44]) // Nonce, protocol and ports
+		copy(response[44:60], []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 198, 51, 100, 23})
+		return response
+	})
+
+	ip, err := natpmpSource{routeFile: routeFile, port: port}.IP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "198.51.100.23" {
+		t.Errorf("expected: 198.51.100.23, got: %s", ip)
+	}
+}
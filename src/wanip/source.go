@@ -0,0 +1,320 @@
+package wanip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"bjoernblessin.de/gorkbunddns/src/porkbun"
+	"bjoernblessin.de/gorkbunddns/src/util/assert"
+	"bjoernblessin.de/gorkbunddns/src/util/logger"
+)
+
+// Family is the address family of an IP source.
+type Family string
+
+const IPv4 Family = "ipv4"
+const IPv6 Family = "ipv6"
+
+const FritzBoxSourceName = "fritzbox"
+const HTTPSourceName = "http"
+const PorkbunSourceName = "porkbun"
+
+// ErrCGNAT means that a source returned an address of the shared address space of carrier-grade NAT (RFC 6598).
+// The connection has no public IPv4 then, e.g. because of DS-Lite.
+var ErrCGNAT = errors.New("Carrier-grade NAT detected.")
+
+// cgnatPrefix is the shared address space of carrier-grade NAT (RFC 6598).
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// bogonPrefixes are special purpose ranges (RFC 6890) that are global unicast for [netip.Addr] but never a valid WAN IP.
+var bogonPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // This network
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved
+	netip.MustParsePrefix("100::/64"),        // Discard-only
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+	netip.MustParsePrefix("3fff::/20"),       // Documentation
+}
+
+// sourceTimeout limits a single source so that a hanging source doesn't block the rest of the chain.
+const sourceTimeout = 10 * time.Second
+
+// IPSource retrieves the current WAN IP of one address family.
+type IPSource interface {
+	// Name identifies the source in the configuration and in log messages, e.g. "fritzbox".
+	Name() string
+	// IP returns the current IP. The address isn't validated yet, see [Chain].
+	IP(ctx context.Context) (netip.Addr, error)
+}
+
+// Options are the settings some sources need.
+type Options struct {
+	// FritzBoxHost is the host name or address of the FRITZ!Box. Empty means DefaultFritzBoxHost.
+	FritzBoxHost string
+	// FritzBoxUsername and FritzBoxPassword are used for TR-064 actions that require authentication.
+	FritzBoxUsername string
+	FritzBoxPassword string
+	// FritzBoxHTTPS enables TR-064 via HTTPS on port 49443.
+	FritzBoxHTTPS bool
+	// PorkbunAPIURL, PorkbunAPIKey and PorkbunSecretKey are used by the porkbun source to ping the Porkbun API.
+	PorkbunAPIURL    string
+	PorkbunAPIKey    string
+	PorkbunSecretKey string
+	// STUNServers are the host:port addresses asked by the stun source. Empty means DefaultSTUNServers.
+	STUNServers []string
+	// DNSQueries are asked by the dns source. Empty means DefaultDNSQueries.
+	DNSQueries []DNSQuery
+	// Interface is the network interface the interface source reads from. Empty means all interfaces.
+	Interface string
+}
+
+// NewSource creates the source called name for family.
+// Returns an error if no such source exists.
+func NewSource(name string, family Family, options Options) (IPSource, error) {
+	assert.Assert(family == IPv4 || family == IPv6, "family must be IPv4 or IPv6")
+
+	switch name {
+	case FritzBoxSourceName:
+		return fritzBoxSource{family: family, fritzBox: NewFritzBox(options)}, nil
+	case HTTPSourceName:
+		return httpSource{family: family}, nil
+	case PorkbunSourceName:
+		return newPorkbunSource(family, options), nil
+	case UPnPSourceName:
+		if family != IPv4 {
+			return nil, fmt.Errorf("IP source %s only supports IPv4.", name)
+		}
+		return upnpSource{ssdpAddr: ssdpMulticastAddr}, nil
+	case STUNSourceName:
+		servers := options.STUNServers
+		if len(servers) == 0 {
+			servers = DefaultSTUNServers
+		}
+		return stunSource{family: family, servers: servers}, nil
+	case DNSSourceName:
+		queries := options.DNSQueries
+		if len(queries) == 0 {
+			queries = DefaultDNSQueries
+		}
+		return dnsSource{family: family, queries: queries}, nil
+	case InterfaceSourceName:
+		return interfaceSource{family: family, name: options.Interface, inet6File: "/proc/net/if_inet6"}, nil
+	case NATPMPSourceName:
+		if family != IPv4 {
+			return nil, fmt.Errorf("IP source %s only supports IPv4.", name)
+		}
+		return natpmpSource{routeFile: "/proc/net/route", port: natpmpPort}, nil
+	default:
+		return nil, fmt.Errorf("Unknown IP source %q. Available sources: %v", name, SourceNames())
+	}
+}
+
+// SourceNames returns the names of all available sources.
+func SourceNames() []string {
+	return []string{FritzBoxSourceName, HTTPSourceName, PorkbunSourceName, UPnPSourceName, NATPMPSourceName, STUNSourceName, DNSSourceName, InterfaceSourceName}
+}
+
+// Result is a validated IP together with the source that produced it.
+type Result struct {
+	IP     netip.Addr
+	Source string
+}
+
+// Chain asks its sources in order until one returns a valid IP.
+type Chain struct {
+	family  Family
+	sources []IPSource
+	// quorum is the number of sources that must return the same IP, 0 and 1 mean that the first valid IP is used.
+	quorum int
+}
+
+// NewChain creates a chain of the sources called names.
+// Returns an error if a source doesn't exist.
+func NewChain(family Family, names []string, options Options) (Chain, error) {
+	chain := Chain{family: family}
+
+	for _, name := range names {
+		source, err := NewSource(name, family, options)
+		if err != nil {
+			return Chain{}, err
+		}
+
+		chain.sources = append(chain.sources, source)
+	}
+
+	return chain, nil
+}
+
+// SetQuorum makes the chain ask its sources in order until quorum of them returned the same valid IP.
+func (c *Chain) SetQuorum(quorum int) {
+	assert.Assert(quorum >= 1, "quorum must be at least 1")
+
+	c.quorum = quorum
+}
+
+// IP returns the first valid IP of the sources, or with a quorum the first IP enough sources agree on.
+// Failed sources are logged and the next source is tried.
+// A carrier-grade NAT address stops the chain, because the public address other sources see belongs to the NAT of the carrier.
+// Returns an error containing all failures if no source succeeded.
+func (c Chain) IP(ctx context.Context) (Result, error) {
+	var errs []error
+	votes := map[netip.Addr][]string{}
+
+	for _, source := range c.sources {
+		sourceCtx, cancel := context.WithTimeout(ctx, sourceTimeout)
+		ip, err := source.IP(sourceCtx)
+		cancel()
+
+		if err == nil {
+			err = validate(ip, c.family)
+		}
+
+		if errors.Is(err, ErrCGNAT) {
+			return Result{}, fmt.Errorf("%s: %w", source.Name(), err)
+		}
+
+		if err != nil {
+			logger.Warnf("Retrieving current WAN %s via %s failed. %s", c.family, source.Name(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", source.Name(), err))
+			continue
+		}
+
+		ip = ip.Unmap()
+		votes[ip] = append(votes[ip], source.Name())
+
+		if len(votes[ip]) < max(c.quorum, 1) {
+			continue
+		}
+
+		sourceNames := strings.Join(votes[ip], ", ")
+		log.Printf("Current WAN %s is %s (source: %s).", c.family, ip, sourceNames)
+
+		return Result{IP: ip, Source: sourceNames}, nil
+	}
+
+	if len(votes) > 0 {
+		errs = append(errs, fmt.Errorf("Less than %d sources agree on the WAN %s: %v", c.quorum, c.family, votes))
+	}
+
+	if len(errs) == 0 {
+		return Result{}, fmt.Errorf("No %s source configured.", c.family)
+	}
+
+	return Result{}, errors.Join(errs...)
+}
+
+// validate checks that ip is a public unicast address of family. Private, carrier-grade NAT, documentation, loopback, multicast and unspecified addresses are rejected.
+func validate(ip netip.Addr, family Family) error {
+	if !ip.IsValid() {
+		return fmt.Errorf("Invalid IP.")
+	}
+
+	ip = ip.Unmap()
+
+	if family == IPv4 && !ip.Is4() {
+		return fmt.Errorf("%s is not an IPv4 address.", ip)
+	}
+	if family == IPv6 && !ip.Is6() {
+		return fmt.Errorf("%s is not an IPv6 address.", ip)
+	}
+
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("%s is not a public unicast address.", ip)
+	}
+
+	if cgnatPrefix.Contains(ip) {
+		return fmt.Errorf("%s is in the carrier-grade NAT range %s. %w", ip, cgnatPrefix, ErrCGNAT)
+	}
+
+	for _, prefix := range bogonPrefixes {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%s is in the reserved range %s.", ip, prefix)
+		}
+	}
+
+	return nil
+}
+
+// parseAddr parses the IP returned by a source.
+func parseAddr(ip string, err error) (netip.Addr, error) {
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Invalid IP %q.", ip)
+	}
+
+	return addr.Unmap(), nil
+}
+
+// fritzBoxSource asks the FRITZ!Box via TR-064 for its WAN IP.
+type fritzBoxSource struct {
+	family   Family
+	fritzBox *FritzBox
+}
+
+func (s fritzBoxSource) Name() string {
+	return FritzBoxSourceName
+}
+
+func (s fritzBoxSource) IP(ctx context.Context) (netip.Addr, error) {
+	return parseAddr(s.fritzBox.ExternalIP(ctx, s.family))
+}
+
+// httpSource asks an HTTP echo service which IP the host connects from.
+type httpSource struct {
+	family Family
+}
+
+func (s httpSource) Name() string {
+	return HTTPSourceName
+}
+
+func (s httpSource) IP(ctx context.Context) (netip.Addr, error) {
+	network := "tcp4"
+	if s.family == IPv6 {
+		network = "tcp6"
+	}
+
+	return parseAddr(getFromHTTPEcho(ctx, network))
+}
+
+// porkbunSource asks the ping endpoint of the Porkbun API which IP the host connects from.
+type porkbunSource struct {
+	client *porkbun.Client
+}
+
+func newPorkbunSource(family Family, options Options) porkbunSource {
+	network := "tcp4"
+	if family == IPv6 {
+		network = "tcp6"
+	}
+
+	httpClient := &http.Client{Transport: familyOnlyTransport(network), Timeout: sourceTimeout}
+	client := porkbun.NewClient(options.PorkbunAPIURL, httpClient, options.PorkbunAPIKey, options.PorkbunSecretKey)
+
+	// The chain falls back to the next source instead
+	client.SetRetryPolicy(porkbun.RetryPolicy{MaxAttempts: 1})
+
+	return porkbunSource{client: client}
+}
+
+func (s porkbunSource) Name() string {
+	return PorkbunSourceName
+}
+
+func (s porkbunSource) IP(ctx context.Context) (netip.Addr, error) {
+	return parseAddr(s.client.Ping(ctx))
+}
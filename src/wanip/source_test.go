@@ -0,0 +1,123 @@
+package wanip
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// fakeSource returns a fixed IP or error.
+type fakeSource struct {
+	name string
+	ip   string
+	err  error
+}
+
+func (s fakeSource) Name() string {
+	return s.name
+}
+
+func (s fakeSource) IP(ctx context.Context) (netip.Addr, error) {
+	if s.err != nil {
+		return netip.Addr{}, s.err
+	}
+
+	return netip.MustParseAddr(s.ip), nil
+}
+
+func TestChainFallback(t *testing.T) {
+	tests := []struct {
+		name           string
+		family         Family
+		quorum         int
+		sources        []IPSource
+		expectedIP     string
+		expectedSource string
+	}{
+		{"FirstSucceeds", IPv4, 0, []IPSource{fakeSource{name: "a", ip: "1.1.1.1"}, fakeSource{name: "b", ip: "9.9.9.9"}}, "1.1.1.1", "a"},
+		{"FirstFails", IPv4, 0, []IPSource{fakeSource{name: "a", err: errors.New("timeout")}, fakeSource{name: "b", ip: "9.9.9.9"}}, "9.9.9.9", "b"},
+		{"PrivateIsSkipped", IPv4, 0, []IPSource{fakeSource{name: "a", ip: "192.168.178.1"}, fakeSource{name: "b", ip: "9.9.9.9"}}, "9.9.9.9", "b"},
+		{"UnspecifiedIsSkipped", IPv4, 0, []IPSource{fakeSource{name: "a", ip: "0.0.0.0"}, fakeSource{name: "b", ip: "9.9.9.9"}}, "9.9.9.9", "b"},
+		{"DocumentationIsSkipped", IPv4, 0, []IPSource{fakeSource{name: "a", ip: "203.0.113.1"}, fakeSource{name: "b", ip: "9.9.9.9"}}, "9.9.9.9", "b"},
+		{"WrongFamilyIsSkipped", IPv6, 0, []IPSource{fakeSource{name: "a", ip: "1.1.1.1"}, fakeSource{name: "b", ip: "2606:4700:4700::1111"}}, "2606:4700:4700::1111", "b"},
+		{"LinkLocalIsSkipped", IPv6, 0, []IPSource{fakeSource{name: "a", ip: "fe80::1"}, fakeSource{name: "b", ip: "2606:4700:4700::1111"}}, "2606:4700:4700::1111", "b"},
+		{"IPv6DocumentationIsSkipped", IPv6, 0, []IPSource{fakeSource{name: "a", ip: "2001:db8::1"}, fakeSource{name: "b", ip: "2606:4700:4700::1111"}}, "2606:4700:4700::1111", "b"},
+		{"Quorum", IPv4, 2, []IPSource{fakeSource{name: "a", ip: "1.1.1.1"}, fakeSource{name: "b", ip: "9.9.9.9"}, fakeSource{name: "c", ip: "1.1.1.1"}}, "1.1.1.1", "a, c"},
+	}
+
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			chain := Chain{family: testcase.family, sources: testcase.sources, quorum: testcase.quorum}
+
+			result, err := chain.IP(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.IP.String() != testcase.expectedIP || result.Source != testcase.expectedSource {
+				t.Errorf("expected: %s (%s), got: %s (%s)", testcase.expectedIP, testcase.expectedSource, result.IP, result.Source)
+			}
+		})
+	}
+}
+
+func TestChainAllFail(t *testing.T) {
+	chain := Chain{family: IPv4, sources: []IPSource{fakeSource{name: "a", err: errors.New("timeout")}, fakeSource{name: "b", ip: "10.0.0.1"}}}
+
+	_, err := chain.IP(context.Background())
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestChainNoQuorum(t *testing.T) {
+	chain := Chain{family: IPv4, sources: []IPSource{fakeSource{name: "a", ip: "1.1.1.1"}, fakeSource{name: "b", ip: "9.9.9.9"}}}
+	chain.SetQuorum(2)
+
+	_, err := chain.IP(context.Background())
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestChainCGNAT(t *testing.T) {
+	chain := Chain{family: IPv4, sources: []IPSource{fakeSource{name: "a", ip: "100.64.12.34"}, fakeSource{name: "b", ip: "9.9.9.9"}}}
+
+	_, err := chain.IP(context.Background())
+	if !errors.Is(err, ErrCGNAT) {
+		t.Errorf("expected: %s, got: %v", ErrCGNAT, err)
+	}
+}
+
+func TestNewChain(t *testing.T) {
+	if _, err := NewChain(IPv4, []string{FritzBoxSourceName, HTTPSourceName, PorkbunSourceName}, Options{}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	if _, err := NewChain(IPv4, []string{"unknown"}, Options{}); err == nil {
+		t.Errorf("expected an error for an unknown source")
+	}
+}
+
+func TestPorkbunSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"status":"SUCCESS","yourIp":"203.0.113.5"}`))
+	}))
+	defer server.Close()
+
+	source, err := NewSource(PorkbunSourceName, IPv4, Options{PorkbunAPIURL: server.URL, PorkbunAPIKey: "pk1_test", PorkbunSecretKey: "sk1_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := source.IP(context.Background())
+	if err != nil || ip.String() != "203.0.113.5" {
+		t.Errorf("expected: 203.0.113.5, got: %s (%v)", ip, err)
+	}
+}
@@ -0,0 +1,226 @@
+package wanip
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const STUNSourceName = "stun"
+
+// DefaultSTUNServers are asked by the stun source if no servers are configured. All of them are reachable via IPv4 and IPv6.
+var DefaultSTUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478", "stun.nextcloud.com:443"}
+
+const stunMagicCookie = 0x2112A442
+
+const (
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunBindingError         = 0x0111
+	stunAttrMappedAddress    = 0x0001
+	stunAttrErrorCode        = 0x0009
+	stunAttrXORMappedAddress = 0x0020
+)
+
+// stunSource sends STUN Binding requests (RFC 8489) to several servers and returns the address most of them see.
+type stunSource struct {
+	family  Family
+	servers []string
+}
+
+func (s stunSource) Name() string {
+	return STUNSourceName
+}
+
+// IP asks all servers at once. The address reported by more than half of the servers is returned as soon as it is known.
+// Otherwise, after all servers answered or failed, the address reported by more than half of the answering servers is returned.
+func (s stunSource) IP(ctx context.Context) (netip.Addr, error) {
+	if len(s.servers) == 0 {
+		return netip.Addr{}, fmt.Errorf("No STUN servers configured.")
+	}
+
+	network := "udp4"
+	if s.family == IPv6 {
+		network = "udp6"
+	}
+
+	// Stops the remaining requests once the result is known
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type answer struct {
+		server string
+		ip     netip.Addr
+		err    error
+	}
+
+	answers := make(chan answer, len(s.servers))
+
+	for _, server := range s.servers {
+		go func() {
+			ip, err := stunMappedAddress(ctx, network, server)
+			answers <- answer{server: server, ip: ip, err: err}
+		}()
+	}
+
+	votes := map[netip.Addr]int{}
+	answered := 0
+	var errs []error
+
+	for range s.servers {
+		a := <-answers
+		if a.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.server, a.err))
+			continue
+		}
+
+		answered++
+		votes[a.ip]++
+
+		if votes[a.ip] > len(s.servers)/2 {
+			return a.ip, nil
+		}
+	}
+
+	if answered == 0 {
+		return netip.Addr{}, errors.Join(errs...)
+	}
+
+	for ip, count := range votes {
+		if count > answered/2 {
+			return ip, nil
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("The STUN servers disagree about the public address: %v", votes)
+}
+
+// stunMappedAddress sends a Binding request to server and returns the reflexive transport address of the response.
+// The request is retransmitted as specified in RFC 8489 section 6.2.1: an initial RTO of 500ms doubled each time, 7 requests and a final wait of 16 RTO.
+// The schedule takes 39.5 seconds, which is more than sourceTimeout, so only 5 requests are sent. The README documents the truncation.
+func stunMappedAddress(ctx context.Context, network string, server string) (netip.Addr, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("Could not open UDP socket to STUN server. %w", err)
+	}
+	defer conn.Close()
+
+	transactionID := make([]byte, 12)
+	rand.Read(transactionID)
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	copy(request[8:20], transactionID)
+
+	timeouts := []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 8 * time.Second}
+
+	var ip netip.Addr
+
+	err = exchange(ctx, conn.(*net.UDPConn), request, timeouts, func(response []byte) (bool, error) {
+		if len(response) < 20 || !bytes.Equal(response[8:20], transactionID) {
+			return false, nil
+		}
+
+		var err error
+		ip, err = parseSTUNResponse(response)
+		return true, err
+	})
+
+	return ip, err
+}
+
+// parseSTUNResponse returns the address of the XOR-MAPPED-ADDRESS attribute of a Binding success response.
+// Servers implementing only RFC 3489 send a MAPPED-ADDRESS attribute instead, which is used as fallback.
+func parseSTUNResponse(response []byte) (netip.Addr, error) {
+	if len(response) < 20 || binary.BigEndian.Uint32(response[4:8]) != stunMagicCookie {
+		return netip.Addr{}, fmt.Errorf("Invalid STUN response.")
+	}
+
+	messageType := binary.BigEndian.Uint16(response[0:2])
+	length := int(binary.BigEndian.Uint16(response[2:4]))
+	if messageType != stunBindingSuccess && messageType != stunBindingError {
+		return netip.Addr{}, fmt.Errorf("Unexpected STUN message type %#04x.", messageType)
+	}
+	if 20+length > len(response) {
+		return netip.Addr{}, fmt.Errorf("Truncated STUN response.")
+	}
+
+	var mappedAddress netip.Addr
+
+	attributes := response[20 : 20+length]
+	for len(attributes) >= 4 {
+		attributeType := binary.BigEndian.Uint16(attributes[0:2])
+		attributeLength := int(binary.BigEndian.Uint16(attributes[2:4]))
+		if 4+attributeLength > len(attributes) {
+			return netip.Addr{}, fmt.Errorf("Truncated STUN attribute %#04x.", attributeType)
+		}
+		value := attributes[4 : 4+attributeLength]
+
+		switch attributeType {
+		case stunAttrErrorCode:
+			if messageType == stunBindingError && len(value) >= 4 {
+				return netip.Addr{}, fmt.Errorf("STUN server responded with error %d %s.", int(value[2]&0x7)*100+int(value[3]), value[4:])
+			}
+		case stunAttrXORMappedAddress:
+			// The address is XORed with the magic cookie and the transaction ID, which are the bytes 4 to 20 of the header
+			return parseSTUNAddress(value, response[4:20])
+		case stunAttrMappedAddress:
+			ip, err := parseSTUNAddress(value, make([]byte, 16))
+			if err == nil {
+				mappedAddress = ip
+			}
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		next := 4 + (attributeLength+3)/4*4
+		if next > len(attributes) {
+			break
+		}
+		attributes = attributes[next:]
+	}
+
+	if messageType == stunBindingError {
+		return netip.Addr{}, fmt.Errorf("STUN server responded with an error.")
+	}
+
+	if !mappedAddress.IsValid() {
+		return netip.Addr{}, fmt.Errorf("STUN response contains no mapped address.")
+	}
+
+	return mappedAddress, nil
+}
+
+// parseSTUNAddress parses the value of a (XOR-)MAPPED-ADDRESS attribute. The address bytes are XORed with the first bytes of mask.
+func parseSTUNAddress(value []byte, mask []byte) (netip.Addr, error) {
+	if len(value) < 4 {
+		return netip.Addr{}, fmt.Errorf("Invalid STUN address attribute.")
+	}
+
+	addressLength := 4
+	if value[1] == 0x02 {
+		addressLength = 16
+	} else if value[1] != 0x01 {
+		return netip.Addr{}, fmt.Errorf("Unknown STUN address family %#02x.", value[1])
+	}
+
+	if len(value) < 4+addressLength {
+		return netip.Addr{}, fmt.Errorf("Invalid STUN address attribute.")
+	}
+
+	address := make([]byte, addressLength)
+	for i := range address {
+		address[i] = value[4+i] ^ mask[i]
+	}
+
+	ip, _ := netip.AddrFromSlice(address)
+	return ip, nil
+}
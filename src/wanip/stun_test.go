@@ -0,0 +1,179 @@
+package wanip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// stunAttribute encodes a STUN attribute including its padding.
+func stunAttribute(attributeType uint16, value []byte) []byte {
+	attribute := binary.BigEndian.AppendUint16(nil, attributeType)
+	attribute = binary.BigEndian.AppendUint16(attribute, uint16(len(value)))
+	attribute = append(attribute, value...)
+
+	for len(attribute)%4 != 0 {
+		attribute = append(attribute, 0)
+	}
+
+	return attribute
+}
+
+// stunAddressAttribute encodes ip as (XOR-)MAPPED-ADDRESS attribute for the response to transactionID.
+func stunAddressAttribute(attributeType uint16, ip netip.Addr, transactionID []byte) []byte {
+	family := byte(0x01)
+	if ip.Is6() {
+		family = 0x02
+	}
+
+	value := []byte{0, family, 0x12, 0x34}
+	value = append(value, ip.AsSlice()...)
+
+	if attributeType == stunAttrXORMappedAddress {
+		mask := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+		mask = append(mask, transactionID...)
+		for i := range ip.AsSlice() {
+			value[4+i] ^= mask[i]
+		}
+	}
+
+	return stunAttribute(attributeType, value)
+}
+
+// stunMessage encodes a STUN message of messageType with the given attributes.
+func stunMessage(messageType uint16, transactionID []byte, attributes ...[]byte) []byte {
+	var body []byte
+	for _, attribute := range attributes {
+		body = append(body, attribute...)
+	}
+
+	message := binary.BigEndian.AppendUint16(nil, messageType)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(body)))
+	message = binary.BigEndian.AppendUint32(message, stunMagicCookie)
+	message = append(message, transactionID...)
+
+	return append(message, body...)
+}
+
+// fakeSTUNServer starts a STUN server on 127.0.0.1 that reports mappedIP to every client. Returns its address.
+func fakeSTUNServer(t *testing.T, mappedIP string) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1100)
+		for {
+			n, remoteAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			if n != 20 || binary.BigEndian.Uint16(buffer[0:2]) != stunBindingRequest {
+				continue
+			}
+
+			transactionID := buffer[8:20]
+			response := stunMessage(stunBindingSuccess, transactionID,
+				stunAddressAttribute(stunAttrXORMappedAddress, netip.MustParseAddr(mappedIP), transactionID))
+			conn.WriteToUDP(response, remoteAddr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestSTUNSource(t *testing.T) {
+	servers := []string{
+		fakeSTUNServer(t, "203.0.113.7"),
+		fakeSTUNServer(t, "198.51.100.1"),
+		fakeSTUNServer(t, "203.0.113.7"),
+	}
+
+	ip, err := stunSource{family: IPv4, servers: servers}.IP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "203.0.113.7" {
+		t.Errorf("expected: 203.0.113.7, got: %s", ip)
+	}
+}
+
+func TestSTUNSourceDisagree(t *testing.T) {
+	servers := []string{
+		fakeSTUNServer(t, "203.0.113.7"),
+		fakeSTUNServer(t, "198.51.100.1"),
+	}
+
+	_, err := stunSource{family: IPv4, servers: servers}.IP(context.Background())
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	transactionID := []byte("0123456789ab")
+
+	tests := []struct {
+		name     string
+		response []byte
+		expected string
+	}{
+		{
+			name: "XOR-MAPPED-ADDRESS IPv6",
+			response: stunMessage(stunBindingSuccess, transactionID,
+				stunAttribute(0x8022, []byte("fake server")),
+				stunAddressAttribute(stunAttrXORMappedAddress, netip.MustParseAddr("2001:db8::1"), transactionID)),
+			expected: "2001:db8::1",
+		},
+		{
+			name: "MAPPED-ADDRESS only",
+			response: stunMessage(stunBindingSuccess, transactionID,
+				stunAddressAttribute(stunAttrMappedAddress, netip.MustParseAddr("203.0.113.7"), transactionID)),
+			expected: "203.0.113.7",
+		},
+		{
+			name: "XOR-MAPPED-ADDRESS preferred",
+			response: stunMessage(stunBindingSuccess, transactionID,
+				stunAddressAttribute(stunAttrMappedAddress, netip.MustParseAddr("10.0.0.1"), transactionID),
+				stunAddressAttribute(stunAttrXORMappedAddress, netip.MustParseAddr("203.0.113.7"), transactionID)),
+			expected: "203.0.113.7",
+		},
+		{
+			name: "Error response",
+			response: stunMessage(stunBindingError, transactionID,
+				stunAttribute(stunAttrErrorCode, append([]byte{0, 0, 4, 0}, "Bad Request"...))),
+			expected: "",
+		},
+		{
+			name:     "No address",
+			response: stunMessage(stunBindingSuccess, transactionID),
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		ip, err := parseSTUNResponse(test.response)
+
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got: %s", test.name, ip)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if ip.String() != test.expected {
+			t.Errorf("%s: expected: %s, got: %s", test.name, test.expected, ip)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package wanip
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"bjoernblessin.de/gorkbunddns/src/util/assert"
+)
+
+// TR064Client calls the actions of the services listed in the device description of a TR-064 (or UPnP) device, e.g. a FRITZ!Box.
+// The device description and the service descriptions (SCPD) are loaded on first use and cached until a call fails with 404 or a transport error.
+// Requests answered with 401 are repeated with HTTP digest authentication if a username or password is set.
+type TR064Client struct {
+	descriptionURL string
+	httpClient     *http.Client
+	username       string
+	password       string
+
+	mutex sync.Mutex
+	// services maps the service types of the device description to the services, nil until the description is loaded.
+	services map[string]*tr064Service
+}
+
+type tr064Service struct {
+	controlURL string
+	scpdURL    string
+	// actions are the names of the actions of the SCPD, nil until the SCPD is loaded.
+	actions []string
+}
+
+// NewTR064Client creates a client for the device described at descriptionURL, e.g. "http://fritz.box:49000/tr64desc.xml".
+func NewTR064Client(descriptionURL string, httpClient *http.Client, username string, password string) *TR064Client {
+	return &TR064Client{descriptionURL: descriptionURL, httpClient: httpClient, username: username, password: password}
+}
+
+// Call invokes action of the service of serviceType with arguments and returns the out arguments of the response by name.
+// Returns an error if the device has no such service or action, or if it responds with a SOAP fault.
+func (c *TR064Client) Call(ctx context.Context, serviceType string, action string, arguments map[string]string) (map[string]string, error) {
+	service, err := c.service(ctx, serviceType)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(service.actions, action) {
+		return nil, fmt.Errorf("Service %s has no action %s.", serviceType, action)
+	}
+
+	var argumentsXML strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(arguments)) {
+		argumentsXML.WriteString("<" + name + ">")
+		xml.EscapeText(&argumentsXML, []byte(arguments[name]))
+		argumentsXML.WriteString("</" + name + ">")
+	}
+
+	soapRequest := `<?xml version="1.0" encoding="utf-8"?>
+	<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+	   <s:Body>
+	      <u:` + action + ` xmlns:u="` + serviceType + `">` + argumentsXML.String() + `</u:` + action + `>
+	   </s:Body>
+	</s:Envelope>`
+
+	header := http.Header{}
+	header.Set("Content-Type", "text/xml; charset=utf-8")
+	header.Set("SOAPACTION", serviceType+"#"+action)
+
+	resp, err := c.do(ctx, "POST", service.controlURL, soapRequest, header)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// E.g. the device rebooted or its address changed
+		c.forgetServices()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		// The control URL is stale, e.g. after a firmware update
+		c.forgetServices()
+	}
+
+	var response _TR064ResponseEnvelope
+
+	err = xml.NewDecoder(resp.Body).Decode(&response)
+	if err != nil && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s#%s failed with %s.", serviceType, action, resp.Status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse XML %w", err)
+	}
+
+	if fault := response.Body.Fault; fault != nil {
+		return nil, fmt.Errorf("%s#%s failed with UPnP error %s %s.", serviceType, action, fault.ErrorCode, fault.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s#%s failed with %s.", serviceType, action, resp.Status)
+	}
+
+	results := map[string]string{}
+	for _, argument := range response.Body.Response.Arguments {
+		results[argument.XMLName.Local] = argument.Value
+	}
+
+	return results, nil
+}
+
+type _TR064ResponseEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Fault *struct {
+			ErrorCode        string `xml:"detail>UPnPError>errorCode"`
+			ErrorDescription string `xml:"detail>UPnPError>errorDescription"`
+		} `xml:"Fault"`
+		// Response is the <ActionResponse> element, whose children are the out arguments.
+		Response struct {
+			Arguments []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// tr064SCPD is the service description of a service.
+type tr064SCPD struct {
+	Actions []struct {
+		Name string `xml:"name"`
+	} `xml:"actionList>action"`
+}
+
+// service returns the service of serviceType. The device description and the SCPD of the service are loaded if they aren't cached yet.
+func (c *TR064Client) service(ctx context.Context, serviceType string) (*tr064Service, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.services == nil {
+		services, err := c.loadDescription(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.services = services
+	}
+
+	service, present := c.services[serviceType]
+	if !present {
+		return nil, fmt.Errorf("Device at %s has no service %s.", c.descriptionURL, serviceType)
+	}
+
+	if service.actions == nil {
+		var scpd tr064SCPD
+
+		err := c.getXML(ctx, service.scpdURL, &scpd)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load the description of service %s. %w", serviceType, err)
+		}
+
+		service.actions = []string{}
+		for _, action := range scpd.Actions {
+			service.actions = append(service.actions, action.Name)
+		}
+	}
+
+	return service, nil
+}
+
+// forgetServices drops the cached device description and SCPDs, so that the next call loads them again.
+func (c *TR064Client) forgetServices() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.services = nil
+}
+
+// loadDescription loads the device description and returns all services of the device and its embedded devices by type.
+func (c *TR064Client) loadDescription(ctx context.Context) (map[string]*tr064Service, error) {
+	var description upnpDescription
+
+	err := c.getXML(ctx, c.descriptionURL, &description)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load the device description. %w", err)
+	}
+
+	// Relative URLs are resolved against URLBase (UPnP 1.0) or the location of the description
+	base := description.URLBase
+	if base == "" {
+		base = c.descriptionURL
+	}
+
+	services := map[string]*tr064Service{}
+
+	var collect func(device upnpDevice) error
+	collect = func(device upnpDevice) error {
+		for _, service := range device.Services {
+			controlURL, err := resolveURL(base, service.ControlURL)
+			if err != nil {
+				return err
+			}
+
+			scpdURL, err := resolveURL(base, service.SCPDURL)
+			if err != nil {
+				return err
+			}
+
+			if _, present := services[service.ServiceType]; !present {
+				services[service.ServiceType] = &tr064Service{controlURL: controlURL, scpdURL: scpdURL}
+			}
+		}
+
+		for _, embeddedDevice := range device.Devices {
+			err := collect(embeddedDevice)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err = collect(description.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// getXML requests rawURL and decodes the XML response into v.
+func (c *TR064Client) getXML(ctx context.Context, rawURL string, v any) error {
+	resp, err := c.do(ctx, "GET", rawURL, "", http.Header{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s failed with %s.", rawURL, resp.Status)
+	}
+
+	err = xml.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("Couldn't parse XML of %s %w", rawURL, err)
+	}
+
+	return nil
+}
+
+// do sends a request and repeats it with digest authentication if the device answers 401 and credentials are set.
+func (c *TR064Client) do(ctx context.Context, method string, rawURL string, body string, header http.Header) (*http.Response, error) {
+	newRequest := func() *http.Request {
+		request, err := http.NewRequestWithContext(ctx, method, rawURL, strings.NewReader(body))
+		assert.IsNil(err)
+		request.Header = header.Clone()
+		return request
+	}
+
+	resp, err := c.httpClient.Do(newRequest())
+	if err != nil {
+		return nil, fmt.Errorf("Error sending request %w", err)
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized || (c.username == "" && c.password == "") {
+		return resp, nil
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	challenge, err := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return nil, err
+	}
+
+	request := newRequest()
+	request.Header.Set("Authorization", challenge.authorization(c.username, c.password, method, request.URL.RequestURI(), randomCNonce()))
+
+	resp, err = c.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Error sending request %w", err)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Device rejected the username or password.")
+	}
+
+	return resp, nil
+}
+
+// digestChallenge is the WWW-Authenticate header of an HTTP digest authentication (RFC 7616).
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	// qop is empty for the legacy scheme of RFC 2069, "auth" otherwise.
+	qop string
+}
+
+// parseDigestChallenge parses a WWW-Authenticate header like `Digest realm="F!Box SOAP-Auth", nonce="0123", algorithm=MD5, qop="auth"`.
+// Only the MD5 and SHA-256 algorithms with the quality of protection "auth" are supported.
+func parseDigestChallenge(header string) (digestChallenge, error) {
+	scheme, paramsString, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return digestChallenge{}, fmt.Errorf("Device requires unsupported authentication %q.", header)
+	}
+
+	params := parseAuthParams(paramsString)
+
+	challenge := digestChallenge{realm: params["realm"], nonce: params["nonce"], opaque: params["opaque"], algorithm: params["algorithm"]}
+
+	if challenge.algorithm != "" && !strings.EqualFold(challenge.algorithm, "MD5") && !strings.EqualFold(challenge.algorithm, "SHA-256") {
+		return digestChallenge{}, fmt.Errorf("Device requires unsupported digest algorithm %s.", challenge.algorithm)
+	}
+
+	if qop, present := params["qop"]; present {
+		if !slices.Contains(strings.Split(strings.ReplaceAll(qop, " ", ""), ","), "auth") {
+			return digestChallenge{}, fmt.Errorf("Device requires unsupported digest quality of protection %s.", qop)
+		}
+		challenge.qop = "auth"
+	}
+
+	return challenge, nil
+}
+
+// parseAuthParams parses comma-separated key=value pairs whose values may be quoted strings containing commas.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+
+	for {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var builder strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				builder.WriteByte(rest[i])
+			}
+			value = builder.String()
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+
+		params[key] = value
+	}
+}
+
+// authorization returns the Authorization header for a request of method to uri.
+func (d digestChallenge) authorization(username string, password string, method string, uri string, cnonce string) string {
+	newHash := md5.New
+	if strings.EqualFold(d.algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+
+	h := func(s string) string {
+		return hashHex(newHash(), s)
+	}
+
+	ha1 := h(username + ":" + d.realm + ":" + password)
+	ha2 := h(method + ":" + uri)
+
+	const nc = "00000001"
+
+	var response string
+	if d.qop == "" {
+		response = h(ha1 + ":" + d.nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + d.nonce + ":" + nc + ":" + cnonce + ":" + d.qop + ":" + ha2)
+	}
+
+	params := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", d.realm),
+		fmt.Sprintf("nonce=%q", d.nonce),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("response=%q", response),
+	}
+	if d.algorithm != "" {
+		params = append(params, "algorithm="+d.algorithm)
+	}
+	if d.opaque != "" {
+		params = append(params, fmt.Sprintf("opaque=%q", d.opaque))
+	}
+	if d.qop != "" {
+		params = append(params, "qop="+d.qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+
+	return "Digest " + strings.Join(params, ", ")
+}
+
+func hashHex(h hash.Hash, s string) string {
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func randomCNonce() string {
+	cnonce := make([]byte, 16)
+	rand.Read(cnonce)
+	return hex.EncodeToString(cnonce)
+}
+
+// resolveURL resolves reference against base.
+func resolveURL(base string, reference string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("Invalid base URL %q. %w", base, err)
+	}
+
+	referenceURL, err := url.Parse(reference)
+	if err != nil {
+		return "", fmt.Errorf("Invalid URL %q. %w", reference, err)
+	}
+
+	return baseURL.ResolveReference(referenceURL).String(), nil
+}
@@ -0,0 +1,207 @@
+package wanip
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeFritzBox serves the descriptions and responses recorded from a FRITZ!Box 7590 in testdata/fritzbox.
+// The TR-064 control URLs require digest authentication with username and password, the IGD control URL doesn't.
+func fakeFritzBox(t *testing.T, username string, password string) string {
+	return fakeFritzBoxWithResponses(t, username, password, nil)
+}
+
+// fakeFritzBoxWithResponses is like fakeFritzBox, but overrides maps "path#action" to the testdata file of its response.
+func fakeFritzBoxWithResponses(t *testing.T, username string, password string, overrides map[string]string) string {
+	challenge := digestChallenge{realm: "F!Box SOAP-Auth", nonce: "F758BE72FB999CEA", algorithm: "MD5", qop: "auth"}
+
+	responses := map[string]string{
+		"/upnp/control/wanpppconn1#GetExternalIPAddress":                 "GetExternalIPAddressResponse.xml",
+		"/upnp/control/wanipconnection1#X_AVM_DE_GetIPv6Prefix":          "X_AVM_DE_GetIPv6PrefixResponse.xml",
+		"/upnp/control/wanipconnection1#X_AVM_DE_GetExternalIPv6Address": "X_AVM_DE_GetExternalIPv6AddressFault.xml",
+		"/igdupnp/control/WANIPConn1#X_AVM_DE_GetExternalIPv6Address":    "X_AVM_DE_GetExternalIPv6AddressResponse.xml",
+	}
+	maps.Copy(responses, overrides)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			http.ServeFile(w, r, filepath.Join("testdata", "fritzbox", filepath.Base(r.URL.Path)))
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/upnp/control/") {
+			scheme, paramsString, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			params := parseAuthParams(paramsString)
+			expected := parseAuthParams(strings.TrimPrefix(challenge.authorization(username, password, r.Method, r.URL.RequestURI(), params["cnonce"]), "Digest "))
+
+			if scheme != "Digest" || params["response"] != expected["response"] {
+				w.Header().Set("WWW-Authenticate", `Digest realm="F!Box SOAP-Auth", nonce="F758BE72FB999CEA", algorithm=MD5, qop="auth"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		_, action, _ := strings.Cut(r.Header.Get("SOAPACTION"), "#")
+		if !strings.Contains(string(body), "<u:"+action+" ") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response, present := responses[r.URL.Path+"#"+action]
+		if !present {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		content, err := os.ReadFile(filepath.Join("testdata", "fritzbox", response))
+		if err != nil {
+			t.Error(err)
+		}
+
+		if strings.Contains(response, "Fault") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func TestFritzBoxExternalIP(t *testing.T) {
+	serverURL := fakeFritzBox(t, "ddns", "secret")
+	fritzBox := newFritzBox(serverURL, serverURL, http.DefaultClient, "ddns", "secret")
+
+	tests := []struct {
+		family   Family
+		expected string
+	}{
+		// Via the TR-064 WANPPPConnection service with authentication
+		{IPv4, "84.150.23.42"},
+		// The TR-064 WANPPPConnection service has no such action and the WANIPConnection service responds with a fault, so the IGD service is used
+		{IPv6, "2003:e8:1f00:8b00:3a10:d5ff:fe12:3456"},
+	}
+
+	for _, test := range tests {
+		ip, err := fritzBox.ExternalIP(context.Background(), test.family)
+		if err != nil {
+			t.Errorf("%s: %s", test.family, err)
+			continue
+		}
+
+		if ip != test.expected {
+			t.Errorf("expected: %s, got: %s", test.expected, ip)
+		}
+	}
+}
+
+func TestFritzBoxExternalIPUnusedConnection(t *testing.T) {
+	// A cable FRITZ!Box answers on the unused PPP service with 0.0.0.0
+	serverURL := fakeFritzBoxWithResponses(t, "ddns", "secret", map[string]string{
+		"/upnp/control/wanpppconn1#GetExternalIPAddress":      "GetExternalIPAddressUnconnectedResponse.xml",
+		"/upnp/control/wanipconnection1#GetExternalIPAddress": "GetExternalIPAddressIPConnectionResponse.xml",
+	})
+	fritzBox := newFritzBox(serverURL, serverURL, http.DefaultClient, "ddns", "secret")
+
+	ip, err := fritzBox.ExternalIP(context.Background(), IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip != "91.64.117.42" {
+		t.Errorf("expected: 91.64.117.42, got: %s", ip)
+	}
+}
+
+func TestFritzBoxIPv6Prefix(t *testing.T) {
+	serverURL := fakeFritzBox(t, "ddns", "secret")
+	fritzBox := newFritzBox(serverURL, serverURL, http.DefaultClient, "ddns", "secret")
+
+	prefix, prefixLength, err := fritzBox.IPv6Prefix(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prefix != "2003:e8:1f2a:5600::" || prefixLength != 56 {
+		t.Errorf("expected: 2003:e8:1f2a:5600::/56, got: %s/%d", prefix, prefixLength)
+	}
+}
+
+func TestFritzBoxWrongPassword(t *testing.T) {
+	serverURL := fakeFritzBox(t, "ddns", "secret")
+	fritzBox := newFritzBox(serverURL, serverURL, http.DefaultClient, "ddns", "wrong")
+
+	_, err := fritzBox.ExternalIP(context.Background(), IPv4)
+	if err == nil || !strings.Contains(err.Error(), "rejected the username or password") {
+		t.Errorf("expected an authentication error, got: %v", err)
+	}
+}
+
+func TestTR064ClientReloadsStaleServices(t *testing.T) {
+	serverURL := fakeFritzBox(t, "ddns", "secret")
+	client := NewTR064Client(serverURL+"/tr64desc.xml", http.DefaultClient, "ddns", "secret")
+	serviceType := "urn:dslforum-org:service:WANPPPConnection:1"
+
+	_, err := client.Call(context.Background(), serviceType, "GetExternalIPAddress", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// E.g. a FRITZ!OS update moved the control URL
+	client.services[serviceType].controlURL = serverURL + "/upnp/control/moved"
+
+	_, err = client.Call(context.Background(), serviceType, "GetExternalIPAddress", nil)
+	if err == nil {
+		t.Fatal("expected an error for the stale control URL")
+	}
+
+	results, err := client.Call(context.Background(), serviceType, "GetExternalIPAddress", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results["NewExternalIPAddress"] != "84.150.23.42" {
+		t.Errorf("expected: 84.150.23.42, got: %s", results["NewExternalIPAddress"])
+	}
+}
+
+func TestDigestAuthorization(t *testing.T) {
+	// Example of RFC 7616 section 3.9.1
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+			"753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+		{`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=MD5, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+			"8ca523f5e9506fed4657c9700eebdbec"},
+	}
+
+	for _, test := range tests {
+		challenge, err := parseDigestChallenge(test.header)
+		if err != nil {
+			t.Errorf("%s: %s", test.header, err)
+			continue
+		}
+
+		authorization := challenge.authorization("Mufasa", "Circle of Life", "GET", "/dir/index.html", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ")
+
+		params := parseAuthParams(strings.TrimPrefix(authorization, "Digest "))
+		if params["response"] != test.expected || params["opaque"] != "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS" || params["qop"] != "auth" {
+			t.Errorf("expected response: %s, got: %s", test.expected, authorization)
+		}
+	}
+
+	_, err := parseDigestChallenge(`Basic realm="FRITZ!Box"`)
+	if err == nil {
+		t.Errorf("expected an error for basic authentication")
+	}
+}
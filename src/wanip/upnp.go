@@ -0,0 +1,229 @@
+package wanip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"bjoernblessin.de/gorkbunddns/src/util/assert"
+)
+
+const UPnPSourceName = "upnp"
+
+// ssdpMulticastAddr is the standard SSDP address every UPnP device listens on.
+const ssdpMulticastAddr = "239.255.255.250:1900"
+
+// ssdpTimeout is how long to wait for the first answer of an Internet Gateway Device.
+const ssdpTimeout = 3 * time.Second
+
+// igdDeviceTypes are searched for via SSDP, IGD version 2 devices usually answer both.
+var igdDeviceTypes = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+// upnpSource discovers the Internet Gateway Device of the network via SSDP and asks it for its external IPv4.
+type upnpSource struct {
+	// ssdpAddr is where the M-SEARCH request is sent to, ssdpMulticastAddr except in tests.
+	ssdpAddr string
+}
+
+func (s upnpSource) Name() string {
+	return UPnPSourceName
+}
+
+func (s upnpSource) IP(ctx context.Context) (netip.Addr, error) {
+	location, err := discoverIGD(ctx, s.ssdpAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	controlURL, serviceType, err := findWANConnectionService(ctx, location)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return parseAddr(getExternalIPAddress(ctx, controlURL, serviceType))
+}
+
+// discoverIGD sends SSDP M-SEARCH requests to ssdpAddr and returns the description location of the first Internet Gateway Device that answers.
+func discoverIGD(ctx context.Context, ssdpAddr string) (string, error) {
+	remoteAddr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", fmt.Errorf("Invalid SSDP address %s. %w", ssdpAddr, err)
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", fmt.Errorf("Could not open UDP socket for SSDP. %w", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(ssdpTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	for _, deviceType := range igdDeviceTypes {
+		request := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpMulticastAddr + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + deviceType + "\r\n\r\n"
+
+		_, err = conn.WriteToUDP([]byte(request), remoteAddr)
+		if err != nil {
+			return "", fmt.Errorf("Sending SSDP M-SEARCH failed. %w", err)
+		}
+	}
+
+	buffer := make([]byte, 2048)
+
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return "", fmt.Errorf("No Internet Gateway Device answered the SSDP search. %w", err)
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil || response.StatusCode != http.StatusOK {
+			// Not an answer to the search, e.g. a NOTIFY of another device
+			continue
+		}
+
+		location := response.Header.Get("Location")
+		if location != "" && strings.Contains(response.Header.Get("St"), "InternetGatewayDevice") {
+			return location, nil
+		}
+	}
+}
+
+// upnpDescription is the device description XML of a UPnP root device.
+type upnpDescription struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+	SCPDURL     string `xml:"SCPDURL"`
+}
+
+// findService searches d and its embedded devices for a WANIPConnection or WANPPPConnection service.
+func (d upnpDevice) findService() (upnpService, bool) {
+	for _, service := range d.Services {
+		if strings.Contains(service.ServiceType, ":WANIPConnection:") || strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+			return service, true
+		}
+	}
+
+	for _, device := range d.Devices {
+		if service, found := device.findService(); found {
+			return service, true
+		}
+	}
+
+	return upnpService{}, false
+}
+
+// findWANConnectionService loads the device description at location and returns the absolute control URL and the type of the WAN connection service.
+func findWANConnectionService(ctx context.Context, location string) (controlURL string, serviceType string, err error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid device description location %q. %w", location, err)
+	}
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", "", fmt.Errorf("Error requesting device description %w", err)
+	}
+	defer resp.Body.Close()
+
+	var description upnpDescription
+
+	err = xml.NewDecoder(resp.Body).Decode(&description)
+	if err != nil {
+		return "", "", fmt.Errorf("Couldn't parse device description XML %w", err)
+	}
+
+	service, found := description.Device.findService()
+	if !found {
+		return "", "", fmt.Errorf("Device at %s has no WANIPConnection or WANPPPConnection service.", location)
+	}
+
+	// Relative control URLs are resolved against URLBase (UPnP 1.0) or the location of the description
+	base := description.URLBase
+	if base == "" {
+		base = location
+	}
+
+	controlURL, err = resolveURL(base, service.ControlURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	return controlURL, service.ServiceType, nil
+}
+
+type _UPnPExternalIPResponseEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		GetExternalIPAddressResponse struct {
+			NewExternalIPAddress string `xml:"NewExternalIPAddress"`
+		} `xml:"GetExternalIPAddressResponse"`
+	} `xml:"Body"`
+}
+
+// getExternalIPAddress calls the GetExternalIPAddress action of the service of serviceType at controlURL.
+func getExternalIPAddress(ctx context.Context, controlURL string, serviceType string) (string, error) {
+	soapRequest := `<?xml version="1.0" encoding="utf-8"?>
+	<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" soapenv:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+	   <soapenv:Body>
+	      <u:GetExternalIPAddress xmlns:u="` + serviceType + `"/>
+	   </soapenv:Body>
+	</soapenv:Envelope>`
+
+	request, err := http.NewRequestWithContext(ctx, "POST", controlURL, strings.NewReader(soapRequest))
+	assert.IsNil(err)
+
+	request.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	request.Header.Set("SOAPACTION", `"`+serviceType+`#GetExternalIPAddress"`)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("Error sending request %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Internet Gateway Device responded with %s.", resp.Status)
+	}
+
+	var response _UPnPExternalIPResponseEnvelope
+
+	err = xml.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't parse XML %w", err)
+	}
+
+	IPv4 := response.Body.GetExternalIPAddressResponse.NewExternalIPAddress
+	if IPv4 == "" {
+		return "", fmt.Errorf("Empty response from Internet Gateway Device.")
+	}
+
+	return IPv4, nil
+}
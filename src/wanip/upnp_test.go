@@ -0,0 +1,140 @@
+package wanip
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIGD starts an HTTP server serving a device description with an embedded WANPPPConnection service and an SSDP responder announcing it.
+// Returns the address of the SSDP responder.
+func fakeIGD(t *testing.T, externalIP string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			w.Write([]byte(`<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <serviceList>
+      <service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/ctl/L3F</controlURL></service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service><serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType><controlURL>/ctl/PPPConn</controlURL></service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`))
+		case "/ctl/PPPConn":
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get("SOAPACTION") != `"urn:schemas-upnp-org:service:WANPPPConnection:1#GetExternalIPAddress"` || !strings.Contains(string(body), "GetExternalIPAddress") {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANPPPConnection:1"><NewExternalIPAddress>` + externalIP + `</NewExternalIPAddress></u:GetExternalIPAddressResponse>
+</s:Body></s:Envelope>`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, remoteAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			request := string(buffer[:n])
+			if !strings.HasPrefix(request, "M-SEARCH") {
+				continue
+			}
+
+			st := "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+			if !strings.Contains(request, "ST: "+st) {
+				continue
+			}
+
+			response := "HTTP/1.1 200 OK\r\n" +
+				"CACHE-CONTROL: max-age=120\r\n" +
+				"ST: " + st + "\r\n" +
+				"USN: uuid:test::" + st + "\r\n" +
+				"LOCATION: " + server.URL + "/rootDesc.xml\r\n\r\n"
+			conn.WriteToUDP([]byte(response), remoteAddr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestUPnPSource(t *testing.T) {
+	ssdpAddr := fakeIGD(t, "203.0.113.7")
+
+	ip, err := upnpSource{ssdpAddr: ssdpAddr}.IP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "203.0.113.7" {
+		t.Errorf("expected: 203.0.113.7, got: %s", ip)
+	}
+}
+
+func TestUPnPSourceNoIGD(t *testing.T) {
+	// Nothing listens here, so the search times out
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err = upnpSource{ssdpAddr: conn.LocalAddr().String()}.IP(ctx)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestFindServiceURLBase(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<root><URLBase>http://192.168.1.1:5000/</URLBase><device><serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:2</serviceType><controlURL>ctl/IPConn</controlURL></service>
+</serviceList></device></root>`))
+	}))
+	defer server.Close()
+
+	controlURL, serviceType, err := findWANConnectionService(context.Background(), server.URL+"/desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if controlURL != "http://192.168.1.1:5000/ctl/IPConn" || serviceType != "urn:schemas-upnp-org:service:WANIPConnection:2" {
+		t.Errorf("unexpected service: %s %s", controlURL, serviceType)
+	}
+}
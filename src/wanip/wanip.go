@@ -1,159 +1,207 @@
 package wanip
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"time"
 
 	"bjoernblessin.de/gorkbunddns/src/util/assert"
 )
 
-type _IPv4ResponseEnvelope struct {
-	XMLName xml.Name `xml:"Envelope"`
-	Body    struct {
-		GetExternalIPAddressResponse struct {
-			NewExternalIPAddress string `xml:"NewExternalIPAddress"`
-		} `xml:"GetExternalIPAddressResponse"`
-	} `xml:"Body"`
+// DefaultFritzBoxHost is the host name of a FRITZ!Box in its home network.
+const DefaultFritzBoxHost = "fritz.box"
+
+// Service types of the WAN connection of a FRITZ!Box. The TR-064 services (dslforum-org) may require authentication,
+// the IGD services (upnp-org) only exist if the transmission of status information via UPnP is enabled.
+const (
+	tr064WANIPConnection  = "urn:dslforum-org:service:WANIPConnection:1"
+	tr064WANPPPConnection = "urn:dslforum-org:service:WANPPPConnection:1"
+	igdWANIPConnection    = "urn:schemas-upnp-org:service:WANIPConnection:1"
+)
+
+// FritzBox retrieves the WAN addresses of a FRITZ!Box via TR-064, falling back to its IGD UPnP services.
+type FritzBox struct {
+	tr064 *TR064Client
+	igd   *TR064Client
 }
 
-type _IPv6ResponseEnvelope struct {
-	XMLName xml.Name `xml:"Envelope"`
-	Body    struct {
-		X_AVM_DE_GetExternalIPv6AddressResponse struct {
-			NewExternalIPv6Address string `xml:"NewExternalIPv6Address"`
-		} `xml:"X_AVM_DE_GetExternalIPv6AddressResponse"`
-	} `xml:"Body"`
+// NewFritzBox creates a FritzBox for the host, credentials and protocol of options.
+// With HTTPS, TR-064 is used on port 49443. The certificate isn't verified because a FRITZ!Box has a self-signed certificate.
+func NewFritzBox(options Options) *FritzBox {
+	host := options.FritzBoxHost
+	if host == "" {
+		host = DefaultFritzBoxHost
+	}
+
+	tr064URL := "http://" + net.JoinHostPort(host, "49000")
+	httpClient := &http.Client{Timeout: sourceTimeout}
+
+	if options.FritzBoxHTTPS {
+		tr064URL = "https://" + net.JoinHostPort(host, "49443")
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	igdURL := "http://" + net.JoinHostPort(host, "49000")
+
+	return newFritzBox(tr064URL, igdURL, httpClient, options.FritzBoxUsername, options.FritzBoxPassword)
 }
 
-// GetFromFritzBox sends a TR-064 SOAP request to the FRITZ!Box to retrieve the current WAN IP address.
-//
-// ipProtocol is either "ipv4" or "ipv6".
-func GetFromFritzBox(ipProtocol string) (string, error) {
-	assert.Assert(ipProtocol == "ipv4" || ipProtocol == "ipv6", "ipProtocol must be \"ipv4\" or \"ipv6\"")
-
-	soapRequest := `<?xml version="1.0" encoding="utf-8"?>
-	<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:wan="urn:schemas-upnp-org:service:WANIPConnection:1">
-	   <soapenv:Header/>
-	   <soapenv:Body>
-	      <wan:GetExternalIPAddress/>
-	   </soapenv:Body>
-	</soapenv:Envelope>`
-
-	request, err := http.NewRequest("POST", "http://fritz.box:49000/igdupnp/control/WANIPConn1", bytes.NewBuffer([]byte(soapRequest)))
-	assert.IsNil(err)
+// newFritzBox creates a FritzBox whose TR-064 and IGD descriptions are located at the base URLs tr064URL and igdURL.
+func newFritzBox(tr064URL string, igdURL string, httpClient *http.Client, username string, password string) *FritzBox {
+	return &FritzBox{
+		tr064: NewTR064Client(tr064URL+"/tr64desc.xml", httpClient, username, password),
+		igd:   NewTR064Client(igdURL+"/igddesc.xml", &http.Client{Timeout: sourceTimeout}, "", ""),
+	}
+}
+
+// ExternalIP returns the current WAN IP of family.
+func (f *FritzBox) ExternalIP(ctx context.Context, family Family) (string, error) {
+	assert.Assert(family == IPv4 || family == IPv6, "family must be IPv4 or IPv6")
 
-	request.Header.Set("Content-Type", "text/xml; charset=utf-8")
-	if ipProtocol == "ipv4" {
-		request.Header.Set("SOAPACTION", "urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress")
-	} else {
-		request.Header.Set("SOAPACTION", "urn:schemas-upnp-org:service:WANIPConnection:1#X_AVM_DE_GetExternalIPv6Address")
+	action, result := "GetExternalIPAddress", "NewExternalIPAddress"
+	if family == IPv6 {
+		action, result = "X_AVM_DE_GetExternalIPv6Address", "NewExternalIPv6Address"
 	}
 
-	resp, err := (&http.Client{}).Do(request)
+	results, err := f.call(ctx, action, func(results map[string]string) error {
+		return checkExternalIP(results[result], family)
+	})
 	if err != nil {
-		return "", fmt.Errorf("Error sending request %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	if ipProtocol == "ipv4" {
-		var response _IPv4ResponseEnvelope
+	return results[result], nil
+}
 
-		err = xml.NewDecoder(resp.Body).Decode(&response)
-		if err != nil {
-			return "", fmt.Errorf("Couldn't parse XML %w", err)
-		}
+// IPv6Prefix returns the IPv6 prefix delegated by the ISP.
+// The prefix is in the form of "2001:db8:1234:5600::", prefixLength is e.g. 56.
+// If the FRITZ!Box doesn't report a prefix length, 64 is assumed.
+func (f *FritzBox) IPv6Prefix(ctx context.Context) (prefix string, prefixLength int, err error) {
+	results, err := f.call(ctx, "X_AVM_DE_GetIPv6Prefix", func(results map[string]string) error {
+		_, _, err := parseIPv6Prefix(results["NewIPv6Prefix"], results["NewPrefixLength"])
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
 
-		var IPv4 string = response.Body.GetExternalIPAddressResponse.NewExternalIPAddress
-		if IPv4 == "" {
-			return "", fmt.Errorf("Empty response from FritzBox.")
-		}
+	return parseIPv6Prefix(results["NewIPv6Prefix"], results["NewPrefixLength"])
+}
 
-		return IPv4, nil
-	} else {
-		var response _IPv6ResponseEnvelope
+// call calls action of the WAN connection services in order and returns the out arguments of the first call whose out arguments pass check.
+// A DSL connection is a PPP connection, cable and fiber connections are IP connections. The service of an unused connection type may still
+// answer, e.g. with "0.0.0.0", so its answer must be checked before the next service is skipped.
+// Returns an error containing all failures if no call succeeded.
+func (f *FritzBox) call(ctx context.Context, action string, check func(results map[string]string) error) (map[string]string, error) {
+	services := []struct {
+		client      *TR064Client
+		serviceType string
+	}{
+		{f.tr064, tr064WANPPPConnection},
+		{f.tr064, tr064WANIPConnection},
+		{f.igd, igdWANIPConnection},
+	}
 
-		err = xml.NewDecoder(resp.Body).Decode(&response)
-		if err != nil {
-			return "", fmt.Errorf("Couldn't parse XML %w", err)
+	var errs []error
+
+	for _, service := range services {
+		results, err := service.client.Call(ctx, service.serviceType, action, nil)
+		if err == nil {
+			err = check(results)
 		}
 
-		var IPv6 string = response.Body.X_AVM_DE_GetExternalIPv6AddressResponse.NewExternalIPv6Address
-		if IPv6 == "" {
-			return "", fmt.Errorf("Empty response from FritzBox.")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", service.serviceType, err))
+			continue
 		}
 
-		return IPv6, nil
+		return results, nil
 	}
-}
 
-type _IPv6PrefixResponseEnvelope struct {
-	XMLName xml.Name `xml:"Envelope"`
-	Body    struct {
-		X_AVM_DE_GetIPv6PrefixResponse struct {
-			NewIPv6Prefix string `xml:"NewIPv6Prefix"`
-		} `xml:"X_AVM_DE_GetIPv6PrefixResponse"`
-	} `xml:"Body"`
+	return nil, errors.Join(errs...)
 }
 
-// GetIPv6PrefixFromFritzBox sends a TR-064 SOAP request to the FRITZ!Box to retrieve the IPv6 prefix for the local network.
-// The prefix is in the form of "2001:db8:1234:5678::".
-func GetIPv6PrefixFromFritzBox() (string, error) {
-	soapRequest := `<?xml version="1.0" encoding="utf-8"?>
-    <soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:wan="urn:schemas-upnp-org:service:WANIPConnection:1">
-       <soapenv:Header/>
-       <soapenv:Body>
-          <wan:X_AVM_DE_GetIPv6Prefix/>
-       </soapenv:Body>
-    </soapenv:Envelope>`
-
-	request, err := http.NewRequest("POST", "http://fritz.box:49000/igdupnp/control/WANIPConn1", bytes.NewBuffer([]byte(soapRequest)))
-	assert.IsNil(err)
+// checkExternalIP checks the external IP of family of a GetExternalIPAddress or X_AVM_DE_GetExternalIPv6Address response.
+func checkExternalIP(externalIP string, family Family) error {
+	if externalIP == "" {
+		return fmt.Errorf("Empty response from FritzBox.")
+	}
 
-	request.Header.Set("Content-Type", "text/xml; charset=utf-8")
-	request.Header.Set("SOAPACTION", "urn:schemas-upnp-org:service:WANIPConnection:1#X_AVM_DE_GetIPv6Prefix")
+	addr, err := netip.ParseAddr(externalIP)
+	if err != nil {
+		return fmt.Errorf("Invalid IP %q from FritzBox.", externalIP)
+	}
 
-	resp, err := (&http.Client{}).Do(request)
+	// E.g. the service of an unused connection type reports "0.0.0.0"
+	err = validate(addr, family)
 	if err != nil {
-		return "", fmt.Errorf("Error sending request %w", err)
+		return fmt.Errorf("Invalid IP from FritzBox. %w", err)
 	}
-	defer resp.Body.Close()
 
-	var response _IPv6PrefixResponseEnvelope
+	return nil
+}
+
+// parseIPv6Prefix checks the values of a X_AVM_DE_GetIPv6Prefix response.
+func parseIPv6Prefix(IPv6Prefix string, prefixLengthString string) (prefix string, prefixLength int, err error) {
+	if IPv6Prefix == "" {
+		return "", 0, fmt.Errorf("Empty response from FritzBox.")
+	}
 
-	err = xml.NewDecoder(resp.Body).Decode(&response)
+	addr, err := netip.ParseAddr(IPv6Prefix)
 	if err != nil {
-		return "", fmt.Errorf("Couldn't parse XML %w", err)
+		return "", 0, fmt.Errorf("Invalid IPv6 prefix %q from FritzBox.", IPv6Prefix)
 	}
 
-	var IPv6Prefix string = response.Body.X_AVM_DE_GetIPv6PrefixResponse.NewIPv6Prefix
-	if IPv6Prefix == "" {
-		return "", fmt.Errorf("Empty response from FritzBox.")
+	// E.g. during a WAN outage the prefix of a FRITZ!Box may be "::"
+	err = validate(addr, IPv6)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid IPv6 prefix from FritzBox. %w", err)
+	}
+
+	if prefixLengthString == "" {
+		return IPv6Prefix, 64, nil
 	}
 
-	return IPv6Prefix, nil
+	prefixLength, err = strconv.Atoi(prefixLengthString)
+	if err != nil || prefixLength <= 0 || prefixLength > 128 {
+		return "", 0, fmt.Errorf("Invalid prefix length %q from FritzBox.", prefixLengthString)
+	}
+
+	return IPv6Prefix, prefixLength, nil
 }
 
-// GetGlobalUnicastIPv6 retrieves the unicast IPv6 address of the host machine.
-func GetGlobalUnicastIPv6() (string, error) {
-	IPv6OnlyTransport := &http.Transport{
-		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
-			return net.Dial("tcp6", addr)
+// familyOnlyTransport returns a transport that only dials network, i.e. "tcp4" or "tcp6".
+// A server that echoes the client IP then sees the address of that family.
+func familyOnlyTransport(network string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
 		},
 	}
+}
+
+// getFromHTTPEcho asks the ipify service which IP the host connects from.
+//
+// network is either "tcp4" or "tcp6" and selects the address family.
+func getFromHTTPEcho(ctx context.Context, network string) (string, error) {
+	assert.Assert(network == "tcp4" || network == "tcp6", "network must be \"tcp4\" or \"tcp6\"")
 
 	client := &http.Client{
-		Transport: IPv6OnlyTransport,
+		Transport: familyOnlyTransport(network),
 		Timeout:   5 * time.Second,
 	}
 
-	resp, err := client.Get("https://api64.ipify.org?format=json")
+	request, err := http.NewRequestWithContext(ctx, "GET", "https://api64.ipify.org?format=json", nil)
+	assert.IsNil(err)
+
+	resp, err := client.Do(request)
 	if err != nil {
 		return "", fmt.Errorf("Failed to GET ipify service: %w", err)
 	}
@@ -173,18 +221,3 @@ func GetGlobalUnicastIPv6() (string, error) {
 
 	return response.IP, nil
 }
-
-func GetGlobalUnicastIPv6_2() (string, error) {
-	resp, err := http.Get("https://api64.ipify.org")
-	if err != nil {
-		return "", fmt.Errorf("Failed to GET ipify service: %w", err)
-	}
-	defer resp.Body.Close()
-
-	ip, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("Failed to read response: %w", err)
-	}
-
-	return string(ip), nil
-}